@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Services matched by namespace/name, or namespace/* for all services in a namespace.
+type serviceSet map[string]bool
+
+func parseServiceSet(value string) (serviceSet, error) {
+	set := serviceSet{}
+	for _, entry := range splitList(value) {
+		parts := strings.Split(entry, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%#v must be namespace/name or namespace/*", entry)
+		}
+		set[entry] = true
+	}
+	return set, nil
+}
+
+func (set serviceSet) contains(namespace string, name string) bool {
+	return set[namespace+"/"+name] || set[namespace+"/*"]
+}
+
+// The result of checking if a service may be listed and proxied, with the rule that decided it.
+type accessDecision struct {
+	allowed bool
+	reason  string
+}
+
+// Returns if service may be listed and proxied. The first matching rule decides:
+//
+//  1. -denyServices: denied
+//  2. -allowServices: allowed, ignoring the rules below
+//  3. -allowNamespaces: denied if the namespace is not listed
+//  4. -requireAnnotation: denied without the exposeAnnotation
+//  5. -serviceSelector: denied if the labels do not match
+//
+// Otherwise the service is allowed.
+func (s *server) authorize(service *corev1.Service) accessDecision {
+	if s.denyServices.contains(service.Namespace, service.Name) {
+		return accessDecision{false, "denied by -denyServices"}
+	}
+	if s.allowServices.contains(service.Namespace, service.Name) {
+		return accessDecision{true, "allowed by -allowServices"}
+	}
+	if s.allowNamespaces != nil && !s.allowNamespaces[service.Namespace] {
+		return accessDecision{false, "namespace not in -allowNamespaces"}
+	}
+	if s.requireAnnotation && service.Annotations[exposeAnnotation] != "true" {
+		return accessDecision{false, "missing annotation " + exposeAnnotation + `: "true"`}
+	}
+	if s.serviceSelector != nil && !s.serviceSelector.Matches(labels.Set(service.Labels)) {
+		return accessDecision{false, "labels do not match -serviceSelector"}
+	}
+	return accessDecision{true, "allowed by default"}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestParseServiceSet(t *testing.T) {
+	set, err := parseServiceSet("ns/svc, other/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set.contains("ns", "svc") || !set.contains("other", "anything") || set.contains("ns", "svc2") {
+		t.Errorf("unexpected matches for %#v", set)
+	}
+
+	for _, invalid := range []string{"svc", "ns/", "/svc", "a/b/c"} {
+		_, err := parseServiceSet(invalid)
+		if err == nil {
+			t.Errorf("parseServiceSet(%#v) should fail", invalid)
+		}
+	}
+}
+
+func TestAuthorizePrecedence(t *testing.T) {
+	s := newServer(&fakeKubernetesAPIClient{})
+	var err error
+	s.denyServices, err = parseServiceSet("ns/denied,ns/both,blocked/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.allowServices, err = parseServiceSet("ns/both,blocked/allowed,other/allowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.allowNamespaces = map[string]bool{"ns": true, "blocked": true}
+	s.requireAnnotation = true
+	s.serviceSelector, err = labels.Parse("expose=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	annotated := map[string]string{exposeAnnotation: "true"}
+	matching := map[string]string{"expose": "true"}
+	tests := []struct {
+		namespace   string
+		name        string
+		annotations map[string]string
+		labels      map[string]string
+		allowed     bool
+		reason      string
+	}{
+		// deny overrides everything, including allow
+		{"ns", "denied", annotated, matching, false, "denied by -denyServices"},
+		{"ns", "both", annotated, matching, false, "denied by -denyServices"},
+		{"blocked", "allowed", annotated, matching, false, "denied by -denyServices"},
+		// allow overrides the namespace, annotation and selector rules
+		{"other", "allowed", nil, nil, true, "allowed by -allowServices"},
+		// namespace rule before annotation and selector
+		{"other", "svc", annotated, matching, false, "namespace not in -allowNamespaces"},
+		{"other", "svc", nil, nil, false, "namespace not in -allowNamespaces"},
+		// annotation rule before selector
+		{"ns", "svc", nil, nil, false, "missing annotation"},
+		{"ns", "svc", annotated, nil, false, "labels do not match -serviceSelector"},
+		{"ns", "svc", annotated, matching, true, "allowed by default"},
+	}
+	for _, test := range tests {
+		service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: test.namespace, Name: test.name,
+			Annotations: test.annotations, Labels: test.labels}}
+		decision := s.authorize(service)
+		if decision.allowed != test.allowed || !strings.HasPrefix(decision.reason, test.reason) {
+			t.Errorf("authorize(%s/%s annotations=%v labels=%v)=%#v; expected allowed=%t reason=%#v",
+				test.namespace, test.name, test.annotations, test.labels, decision, test.allowed, test.reason)
+		}
+	}
+
+	// no rules: everything is allowed
+	s = newServer(&fakeKubernetesAPIClient{})
+	decision := s.authorize(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "svc"}})
+	if !decision.allowed {
+		t.Errorf("no rules: %#v; expected allowed", decision)
+	}
+}
+
+func TestAuthorizeListAndProxy(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	kwp := newServer(fakeAPI)
+	var err error
+	kwp.denyServices, err = parseServiceSet("namespace/service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	kwp.rootHandler(recorder, r)
+	if strings.Contains(recorder.Body.String(), "/namespace/service/") {
+		t.Errorf("root page must not list the denied service:\n%s", recorder.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("proxying the denied service: status=%d; expected %d", recorder.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Records the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to flush and hijack the underlying ResponseWriter.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// An access log entry in the Google Cloud Logging structured format. See:
+// https://cloud.google.com/logging/docs/structured-logging
+type gcpAccessLog struct {
+	Severity    string         `json:"severity"`
+	Message     string         `json:"message"`
+	HTTPRequest gcpHTTPRequest `json:"httpRequest"`
+}
+
+// See https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#HttpRequest
+type gcpHTTPRequest struct {
+	RequestMethod string `json:"requestMethod"`
+	RequestURL    string `json:"requestUrl"`
+	Status        int    `json:"status"`
+	ResponseSize  int64  `json:"responseSize,string"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	RemoteIP      string `json:"remoteIp"`
+	Latency       string `json:"latency"`
+}
+
+// Writes an access log line for each request to out, in the Google Cloud Logging format.
+type gcpAccessLogHandler struct {
+	handler http.Handler
+	mu      sync.Mutex
+	out     io.Writer
+	// logs errors writing the access log
+	logger *logger
+	// values of these query parameters are redacted in requestUrl
+	redactQueryParams map[string]bool
+}
+
+func newGCPAccessLogHandler(handler http.Handler, out io.Writer, logger *logger) *gcpAccessLogHandler {
+	return &gcpAccessLogHandler{handler: handler, out: out, logger: logger}
+}
+
+func (g *gcpAccessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the proxy rewrites r.URL: save the original
+	requestURL := redactURL(r.URL, g.redactQueryParams)
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w}
+	g.handler.ServeHTTP(recorder, r)
+	latency := time.Since(start)
+
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	severity := "INFO"
+	if status >= 500 {
+		severity = "ERROR"
+	} else if status >= 400 {
+		severity = "WARNING"
+	}
+
+	entry := &gcpAccessLog{
+		Severity: severity,
+		Message:  fmt.Sprintf("%s %s %d", r.Method, requestURL, status),
+		HTTPRequest: gcpHTTPRequest{
+			RequestMethod: r.Method,
+			RequestURL:    requestURL,
+			Status:        status,
+			ResponseSize:  recorder.size,
+			UserAgent:     r.UserAgent(),
+			RemoteIP:      remoteIP,
+			Latency:       fmt.Sprintf("%.9fs", latency.Seconds()),
+		},
+	}
+	serialized, err := json.Marshal(entry)
+	if err != nil {
+		g.logger.warning("failed to serialize access log", logFields{"error": err.Error()})
+		return
+	}
+	serialized = append(serialized, '\n')
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, err = g.out.Write(serialized)
+	if err != nil {
+		g.logger.warning("failed to write access log", logFields{"error": err.Error()})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGCPAccessLog(t *testing.T) {
+	out := &bytes.Buffer{}
+	handler := newGCPAccessLogHandler(http.NotFoundHandler(), out, newTextLogger())
+
+	r := httptest.NewRequest(http.MethodGet, "/namespace/service/80/path?k=v", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Fatalf("expected exactly one log line: %#v", out.String())
+	}
+	entry := map[string]interface{}{}
+	err := json.Unmarshal(out.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry["severity"] != "WARNING" {
+		t.Errorf("severity=%#v; expected WARNING", entry["severity"])
+	}
+	httpRequest, ok := entry["httpRequest"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("httpRequest missing: %s", out.String())
+	}
+	expected := map[string]interface{}{
+		"requestMethod": "GET",
+		"requestUrl":    "/namespace/service/80/path?k=v",
+		"status":        float64(http.StatusNotFound),
+		"remoteIp":      "192.0.2.1",
+	}
+	for k, v := range expected {
+		if httpRequest[k] != v {
+			t.Errorf("httpRequest.%s=%#v; expected %#v", k, httpRequest[k], v)
+		}
+	}
+	latency, ok := httpRequest["latency"].(string)
+	if !ok || !strings.HasSuffix(latency, "s") {
+		t.Errorf("httpRequest.latency=%#v; expected duration in seconds", httpRequest["latency"])
+	}
+}
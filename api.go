@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// JSON response of /api/services.
+type apiServiceList struct {
+	Services []apiService `json:"services"`
+	// if set, pass as ?continue= to get the next page
+	Continue string `json:"continue,omitempty"`
+}
+
+type apiService struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	ClusterIP string    `json:"clusterIP"`
+	TCPPorts  []apiPort `json:"tcpPorts"`
+}
+
+type apiPort struct {
+	Name string `json:"name,omitempty"`
+	Port int32  `json:"port"`
+}
+
+// Returns the services shown on the root page as JSON. Clients can page through them with
+// ?limit=N, then pass the returned continue token as ?continue= to get the next page.
+func (s *server) servicesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.info("servicesAPIHandler", logFields{"method": r.Method,
+		"url": redactURL(r.URL, s.redactQueryParams)})
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts := s.listOptions
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		var err error
+		opts.limit, err = strconv.ParseInt(limit, 10, 64)
+		if err != nil || opts.limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	opts.continueToken = r.URL.Query().Get("continue")
+
+	var services *corev1.ServiceList
+	var err error
+	if opts.limit == 0 && opts.continueToken == "" {
+		services, _, err = s.listDisplayedServices(r.Context())
+	} else {
+		services, err = s.services.list(r.Context(), opts)
+		if err == nil {
+			services.Items = s.filterDisplayed(services.Items)
+		}
+	}
+	if err != nil {
+		if errors.IsResourceExpired(err) {
+			// the continue token is too old: the client must start again
+			http.Error(w, err.Error(), http.StatusGone)
+		} else if errors.IsBadRequest(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	out := &apiServiceList{Services: []apiService{}, Continue: services.Continue}
+	for _, service := range services.Items {
+		tcpPorts := []apiPort{}
+		for _, p := range service.Spec.Ports {
+			if p.Protocol == corev1.ProtocolTCP {
+				tcpPorts = append(tcpPorts, apiPort{p.Name, p.Port})
+			}
+		}
+		out.Services = append(out.Services, apiService{
+			service.Namespace, service.Name, service.Spec.ClusterIP, tcpPorts})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(out)
+	if err != nil {
+		s.logger.warning("failed writing services response", logFields{"error": err.Error()})
+	}
+}
+
+// Returns the services shown on the root page as a CSV file, with one row for each port.
+func (s *server) servicesCSVHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.info("servicesCSVHandler", logFields{"method": r.Method,
+		"url": redactURL(r.URL, s.redactQueryParams)})
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	services, _, err := s.listDisplayedServices(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="services.csv"`)
+	out := csv.NewWriter(w)
+	out.Write([]string{"namespace", "name", "clusterIP", "portName", "port", "protocol"})
+	for _, service := range services.Items {
+		if len(service.Spec.Ports) == 0 {
+			out.Write([]string{service.Namespace, service.Name, service.Spec.ClusterIP, "", "", ""})
+		}
+		for _, p := range service.Spec.Ports {
+			out.Write([]string{service.Namespace, service.Name, service.Spec.ClusterIP,
+				p.Name, strconv.Itoa(int(p.Port)), string(p.Protocol)})
+		}
+	}
+	out.Flush()
+	if out.Error() != nil {
+		s.logger.warning("failed writing services CSV", logFields{"error": out.Error().Error()})
+	}
+}
+
+// JSON response of /api/namespaces.
+type apiNamespaceList struct {
+	Namespaces []apiNamespace `json:"namespaces"`
+}
+
+type apiNamespace struct {
+	Name string `json:"name"`
+	// number of services with at least one TCP port
+	Services int `json:"services"`
+}
+
+// Returns the namespaces with services that can be proxied, sorted by name, with the number of
+// services in each. UIs can use this to choose a namespace before loading its services.
+func (s *server) namespacesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.info("namespacesAPIHandler", logFields{"method": r.Method,
+		"url": redactURL(r.URL, s.redactQueryParams)})
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	services, _, err := s.listDisplayedServices(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	counts := map[string]int{}
+	for _, service := range services.Items {
+		for _, p := range service.Spec.Ports {
+			if p.Protocol == corev1.ProtocolTCP {
+				counts[service.Namespace]++
+				break
+			}
+		}
+	}
+	out := &apiNamespaceList{Namespaces: []apiNamespace{}}
+	for namespace, count := range counts {
+		out.Namespaces = append(out.Namespaces, apiNamespace{namespace, count})
+	}
+	sort.Slice(out.Namespaces, func(i, j int) bool {
+		return out.Namespaces[i].Name < out.Namespaces[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(out)
+	if err != nil {
+		s.logger.warning("failed writing namespaces response", logFields{"error": err.Error()})
+	}
+}
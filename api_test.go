@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServicesAPIPaging(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	for i := 0; i < 5; i++ {
+		f.services.Items = append(f.services.Items, corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: fmt.Sprintf("service%d", i)},
+			Spec: corev1.ServiceSpec{
+				ClusterIP: "10.0.0.1",
+				Ports:     []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+			},
+		})
+	}
+	s := newServer(f)
+
+	get := func(query url.Values) (*httptest.ResponseRecorder, *apiServiceList) {
+		r := httptest.NewRequest(http.MethodGet, "/api/services?"+query.Encode(), nil)
+		recorder := httptest.NewRecorder()
+		s.servicesAPIHandler(recorder, r)
+		out := &apiServiceList{}
+		if recorder.Code == http.StatusOK {
+			err := json.Unmarshal(recorder.Body.Bytes(), out)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder, out
+	}
+
+	var names []string
+	var pages int
+	query := url.Values{"limit": {"2"}}
+	for {
+		recorder, page := get(query)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", recorder.Code, recorder.Body.String())
+		}
+		pages++
+		for _, service := range page.Services {
+			names = append(names, service.Name)
+		}
+		if page.Continue == "" {
+			break
+		}
+		if pages == 1 && len(page.Services) != 2 {
+			t.Errorf("first page has %d services; expected 2", len(page.Services))
+		}
+		query.Set("continue", page.Continue)
+	}
+	if pages != 3 || len(names) != 5 || names[0] != "service0" || names[4] != "service4" {
+		t.Errorf("pages=%d names=%v; expected 3 pages with all 5 services in order", pages, names)
+	}
+
+	_, all := get(url.Values{})
+	if len(all.Services) != 5 || all.Continue != "" {
+		t.Errorf("without limit: %d services continue=%#v", len(all.Services), all.Continue)
+	}
+	if all.Services[0].TCPPorts[0] != (apiPort{"http", 80}) || all.Services[0].ClusterIP != "10.0.0.1" {
+		t.Errorf("unexpected service: %+v", all.Services[0])
+	}
+
+	recorder, _ := get(url.Values{"limit": {"-1"}})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("invalid limit: status=%d; expected BadRequest", recorder.Code)
+	}
+	recorder, _ = get(url.Values{"continue": {"expired"}})
+	if recorder.Code != http.StatusGone {
+		t.Errorf("expired continue token: status=%d; expected Gone", recorder.Code)
+	}
+}
+
+func TestServicesAPIHiddenNamespaces(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	for _, namespace := range []string{"hidden", "namespace"} {
+		f.services.Items = append(f.services.Items, corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "service"},
+		})
+	}
+	s := newServer(f)
+	s.hiddenNamespaces = map[string]bool{"hidden": true}
+
+	for _, query := range []string{"", "?limit=10"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/services"+query, nil)
+		recorder := httptest.NewRecorder()
+		s.servicesAPIHandler(recorder, r)
+		out := &apiServiceList{}
+		err := json.Unmarshal(recorder.Body.Bytes(), out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.Services) != 1 || out.Services[0].Namespace != "namespace" {
+			t.Errorf("query %#v: services=%+v; expected only namespace/service", query, out.Services)
+		}
+	}
+}
+
+func TestServicesCSV(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	f.services.Items = append(f.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+		},
+	})
+	s := newServer(f)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/services.csv", nil)
+	recorder := httptest.NewRecorder()
+	s.servicesCSVHandler(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("Content-Disposition") != `attachment; filename="services.csv"` {
+		t.Errorf("Content-Disposition=%#v", recorder.Header().Get("Content-Disposition"))
+	}
+	expected := "namespace,name,clusterIP,portName,port,protocol\n" +
+		"namespace,service,10.0.0.1,http,80,TCP\n"
+	if recorder.Body.String() != expected {
+		t.Errorf("CSV=%#v; expected %#v", recorder.Body.String(), expected)
+	}
+}
+
+func TestNamespacesAPI(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	tcpPorts := []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}}
+	udpPorts := []corev1.ServicePort{{Protocol: corev1.ProtocolUDP, Port: 53}}
+	for _, service := range []struct {
+		namespace string
+		name      string
+		ports     []corev1.ServicePort
+	}{
+		{"b", "one", tcpPorts},
+		{"a", "one", tcpPorts},
+		{"b", "two", tcpPorts},
+		{"dns", "udp-only", udpPorts},
+		{"a", "udp-only", udpPorts},
+		{"hidden", "one", tcpPorts},
+	} {
+		f.services.Items = append(f.services.Items, corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: service.namespace, Name: service.name},
+			Spec:       corev1.ServiceSpec{Ports: service.ports},
+		})
+	}
+	s := newServer(f)
+	s.hiddenNamespaces = map[string]bool{"hidden": true}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/namespaces", nil)
+	recorder := httptest.NewRecorder()
+	s.namespacesAPIHandler(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", recorder.Code, recorder.Body.String())
+	}
+	out := &apiNamespaceList{}
+	err := json.Unmarshal(recorder.Body.Bytes(), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []apiNamespace{{"a", 1}, {"b", 2}}
+	if fmt.Sprint(out.Namespaces) != fmt.Sprint(expected) {
+		t.Errorf("namespaces=%v; expected %v", out.Namespaces, expected)
+	}
+}
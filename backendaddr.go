@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Fields available to -backendAddrTemplate.
+type backendAddrTemplateData struct {
+	Namespace string
+	Service   string
+	ClusterIP string
+	Port      int64
+}
+
+// Parses a -backendAddrTemplate, and executes it with example data so invalid fields are
+// reported at startup instead of on the first request.
+func parseBackendAddrTemplate(value string) (*template.Template, error) {
+	tmpl, err := template.New("backendAddr").Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	err = tmpl.Execute(&strings.Builder{}, backendAddrTemplateData{"namespace", "service", "10.0.0.1", 80})
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Returns the host:port to connect to for port of service. By default this is the service's
+// ClusterIP, but -backendAddrTemplate can change it, e.g. to send requests through a mesh sidecar.
+func (s *server) backendAddr(service *corev1.Service, port int64) (string, error) {
+	if s.backendAddrTemplate == nil {
+		return net.JoinHostPort(service.Spec.ClusterIP, strconv.FormatInt(port, 10)), nil
+	}
+	out := &strings.Builder{}
+	err := s.backendAddrTemplate.Execute(out, backendAddrTemplateData{
+		service.Namespace, service.Name, service.Spec.ClusterIP, port})
+	if err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBackendAddr(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "svc"},
+		Spec:       corev1.ServiceSpec{ClusterIP: "10.1.2.3"},
+	}
+	s := newServer(&fakeKubernetesAPIClient{})
+	addr, err := s.backendAddr(service, 80)
+	if err != nil || addr != "10.1.2.3:80" {
+		t.Errorf("default backendAddr=%#v, %v", addr, err)
+	}
+
+	ipv6Service := service.DeepCopy()
+	ipv6Service.Spec.ClusterIP = "fd00::1"
+	addr, err = s.backendAddr(ipv6Service, 80)
+	if err != nil || addr != "[fd00::1]:80" {
+		t.Errorf("IPv6 backendAddr=%#v, %v", addr, err)
+	}
+
+	s.backendAddrTemplate, err = parseBackendAddrTemplate("{{.Service}}.{{.Namespace}}.svc:{{.Port}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err = s.backendAddr(service, 80)
+	if err != nil || addr != "svc.ns.svc:80" {
+		t.Errorf("template backendAddr=%#v, %v", addr, err)
+	}
+
+	for _, invalid := range []string{"{{.Missing}}", "{{"} {
+		_, err = parseBackendAddrTemplate(invalid)
+		if err == nil {
+			t.Errorf("parseBackendAddrTemplate(%#v) should fail", invalid)
+		}
+	}
+}
+
+func TestProxyBackendAddrTemplate(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from backend"))
+	}))
+	// the service's ClusterIP and port are not reachable: only the fixed address is
+	fakeAPI.services.Items[0].Spec.ClusterIP = "invalid.example"
+	fakeAPI.services.Items[0].Spec.Ports[0].Port = 80
+	kwp := newServer(fakeAPI)
+	var err error
+	kwp.backendAddrTemplate, err = parseBackendAddrTemplate(fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/namespace/service/80/", nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "from backend" {
+		t.Errorf("status=%d body=%#v; expected response from backend", recorder.Code, recorder.Body.String())
+	}
+}
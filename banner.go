@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Key in the -bannerFile for the banner shown in namespaces without their own.
+const defaultBannerKey = "*"
+
+// Reads a -bannerFile: a JSON object mapping namespace to the banner HTML shown at the top of
+// its services' pages, e.g. {"prod": "PRODUCTION: be careful", "*": "default banner"}.
+func loadBanners(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	banners := map[string]string{}
+	err = json.Unmarshal(data, &banners)
+	if err != nil {
+		return nil, err
+	}
+	return banners, nil
+}
+
+// Returns the banner HTML for namespace, or the empty string for none.
+func namespaceBanner(banners map[string]string, namespace string) string {
+	if banner, ok := banners[namespace]; ok {
+		return banner
+	}
+	return banners[defaultBannerKey]
+}
+
+// Wraps banner HTML so it stands out from the page it is inserted into.
+func bannerHTML(banner string) string {
+	return `<div class="kubewebproxy-banner" style="background:#fd0;color:#000;padding:0.5em;font-weight:bold">` +
+		banner + `</div>`
+}
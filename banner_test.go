@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceBanner(t *testing.T) {
+	bannerPath := filepath.Join(t.TempDir(), "banners.json")
+	err := os.WriteFile(bannerPath, []byte(`{"prod": "PRODUCTION: be careful"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	banners, err := loadBanners(bannerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body><p>page</p></body></html>"))
+	}))
+	prodService := fakeAPI.services.Items[0]
+	prodService.ObjectMeta = metav1.ObjectMeta{Namespace: "prod", Name: "service"}
+	fakeAPI.services.Items = append(fakeAPI.services.Items, prodService)
+	kwp := newServer(fakeAPI)
+	kwp.banners = banners
+
+	proxyBody := func(namespace string) string {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%s/service/%d/", namespace, port), nil)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		return recorder.Body.String()
+	}
+	expected := "<body>" + bannerHTML("PRODUCTION: be careful") + "<p>page</p>"
+	if body := proxyBody("prod"); !strings.Contains(body, expected) {
+		t.Errorf("prod page should contain %#v:\n%s", expected, body)
+	}
+	if body := proxyBody("namespace"); strings.Contains(body, "kubewebproxy-banner") {
+		t.Errorf("non-prod page must not contain a banner:\n%s", body)
+	}
+
+	// the default applies to other namespaces
+	kwp.banners[defaultBannerKey] = "shared cluster"
+	if body := proxyBody("namespace"); !strings.Contains(body, bannerHTML("shared cluster")) {
+		t.Errorf("non-prod page should contain the default banner:\n%s", body)
+	}
+	if body := proxyBody("prod"); strings.Contains(body, "shared cluster") {
+		t.Errorf("prod page must only contain its own banner:\n%s", body)
+	}
+}
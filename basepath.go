@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Returns basePath without trailing slashes, or an error if it is not an absolute path. Returns
+// "" for "" or "/", which serve the proxy at the root.
+func normalizeBasePath(basePath string) (string, error) {
+	if basePath == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(basePath, "/") {
+		return "", fmt.Errorf("base path %#v must start with /", basePath)
+	}
+	return strings.TrimRight(basePath, "/"), nil
+}
+
+// Returns a handler serving handler under -basePath, e.g. when an Ingress routes /kwp/* to the
+// proxy. The prefix is removed before handler sees the request; links and rewritten paths add it
+// back. The health and ready checks are also served without the prefix, since Kubernetes probes
+// connect to the pod directly.
+func (s *server) stripBasePath(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == s.basePath {
+			target := s.basePath + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, s.basePath+"/") {
+			if isRootHealthCheck(r) || r.URL.Path == s.healthPath || r.URL.Path == readyPath {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, s.basePath)
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, s.basePath)
+		handler.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeBasePath(t *testing.T) {
+	for input, expected := range map[string]string{"": "", "/": "", "/kwp": "/kwp", "/kwp/": "/kwp", "/a/b/": "/a/b"} {
+		output, err := normalizeBasePath(input)
+		if err != nil || output != expected {
+			t.Errorf("normalizeBasePath(%#v)=%#v, %v; expected %#v", input, output, err, expected)
+		}
+	}
+	if _, err := normalizeBasePath("kwp"); err == nil {
+		t.Error("relative base path should fail")
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<a href="/link">path=%s original=%s</a>`, r.URL.Path, r.Header.Get(originalURLHeader))
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.basePath = "/kwp"
+	handler := kwp.stripBasePath(http.HandlerFunc(kwp.rootHandler))
+
+	r := httptest.NewRequest(http.MethodGet, "/kwp/", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	expectedLink := fmt.Sprintf(`href="/kwp/namespace/service/%d/"`, port)
+	if !strings.Contains(recorder.Body.String(), expectedLink) {
+		t.Errorf("root page must link to %s:\n%s", expectedLink, recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Body.String(), `action="/kwp/"`) {
+		t.Errorf("filter form must submit to the base path:\n%s", recorder.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/kwp/namespace/service/%d/page", port), nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	expected := fmt.Sprintf(`<a href="/kwp/namespace/service/%d/link">path=/page original=http://example.com/kwp/namespace/service/%d/page</a>`,
+		port, port)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+		t.Errorf("proxy: status=%d body=%#v; expected %#v", recorder.Code, recorder.Body.String(), expected)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/kwp/namespace/service/%d/redirect", port), nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	expectedLocation := fmt.Sprintf("/kwp/namespace/service/%d/login", port)
+	if recorder.Header().Get("Location") != expectedLocation {
+		t.Errorf("Location=%#v; expected %#v", recorder.Header().Get("Location"), expectedLocation)
+	}
+
+	for path, expectedCode := range map[string]int{
+		"/kwp":                 http.StatusMovedPermanently,
+		"/":                    http.StatusNotFound,
+		"/kwpother/":           http.StatusNotFound,
+		"/namespace/service/1": http.StatusNotFound,
+	} {
+		r = httptest.NewRequest(http.MethodGet, path, nil)
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		if recorder.Code != expectedCode {
+			t.Errorf("%s: status=%d; expected %d", path, recorder.Code, expectedCode)
+		}
+	}
+
+	// health checks and metrics are served with the prefix; the health check also without it
+	secureHandler := kwp.makeSecureHandler("noaudience")
+	for path, expectedCode := range map[string]int{
+		"/kwp/health":  http.StatusOK,
+		"/health":      http.StatusOK,
+		"/kwp/metrics": http.StatusOK,
+		"/metrics":     http.StatusNotFound,
+	} {
+		r = httptest.NewRequest(http.MethodGet, path, nil)
+		recorder = httptest.NewRecorder()
+		secureHandler.ServeHTTP(recorder, r)
+		if recorder.Code != expectedCode {
+			t.Errorf("%s: status=%d; expected %d", path, recorder.Code, expectedCode)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Maximum duration of a shared list call. It does not use any caller's context, so it needs its
+// own limit.
+const coalescedListTimeout = 30 * time.Second
+
+// Wraps a serviceInfo so concurrent list calls with the same options share a single API call.
+// This avoids a thundering herd when many users load the service list at the same time.
+type coalescingServiceInfo struct {
+	serviceInfo
+
+	mu       sync.Mutex
+	inflight map[listOptions]*listCall
+}
+
+// A list call that is in progress. done is closed when services and err are set.
+type listCall struct {
+	done     chan struct{}
+	services *corev1.ServiceList
+	err      error
+}
+
+func newCoalescingServiceInfo(services serviceInfo) *coalescingServiceInfo {
+	return &coalescingServiceInfo{serviceInfo: services, inflight: map[listOptions]*listCall{}}
+}
+
+// A context with the values of its parent that is never canceled, like context.WithoutCancel
+// which requires Go 1.21.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c *coalescingServiceInfo) list(ctx context.Context, opts listOptions) (*corev1.ServiceList, error) {
+	c.mu.Lock()
+	call := c.inflight[opts]
+	if call == nil {
+		call = &listCall{done: make(chan struct{})}
+		c.inflight[opts] = call
+		// the call is shared: the caller that starts it canceling must not cancel the others
+		go c.run(detachedContext{ctx}, opts, call)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	// callers sort the items: give each caller its own slice
+	services := *call.services
+	services.Items = append([]corev1.Service(nil), call.services.Items...)
+	return &services, nil
+}
+
+func (c *coalescingServiceInfo) run(ctx context.Context, opts listOptions, call *listCall) {
+	ctx, cancel := context.WithTimeout(ctx, coalescedListTimeout)
+	defer cancel()
+	call.services, call.err = c.serviceInfo.list(ctx, opts)
+	c.mu.Lock()
+	delete(c.inflight, opts)
+	c.mu.Unlock()
+	close(call.done)
+}
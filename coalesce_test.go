@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Blocks list calls until release is closed, and counts them.
+type blockingServiceInfo struct {
+	fakeKubernetesAPIClient
+	started chan struct{}
+	release chan struct{}
+
+	mu        sync.Mutex
+	listCalls int
+}
+
+func (b *blockingServiceInfo) list(ctx context.Context, opts listOptions) (*corev1.ServiceList, error) {
+	b.mu.Lock()
+	b.listCalls++
+	b.mu.Unlock()
+	b.started <- struct{}{}
+	<-b.release
+	return &b.services, nil
+}
+
+// Counts calls to Done by all contexts sharing waiting. On the list path, only the coalescer
+// calls Done, once it is waiting for a shared call.
+type waitCountingContext struct {
+	context.Context
+	waiting *atomic.Int32
+}
+
+func (c waitCountingContext) Done() <-chan struct{} {
+	c.waiting.Add(1)
+	return c.Context.Done()
+}
+
+func waitForCount(count *atomic.Int32, expected int32) {
+	for count.Load() < expected {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalesceRootList(t *testing.T) {
+	blocking := &blockingServiceInfo{
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+	blocking.services.Items = append(blocking.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service"},
+	})
+	kwp := newServer(blocking)
+	waiting := &atomic.Int32{}
+
+	const numRequests = 20
+	var wg sync.WaitGroup
+	codes := make(chan int, numRequests)
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = r.WithContext(waitCountingContext{r.Context(), waiting})
+			recorder := httptest.NewRecorder()
+			kwp.rootHandler(recorder, r)
+			codes <- recorder.Code
+		}()
+	}
+
+	// wait for one call to start and all requests to wait for it
+	<-blocking.started
+	waitForCount(waiting, numRequests)
+	close(blocking.release)
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Error("expected status OK", code)
+		}
+	}
+	if blocking.listCalls != 1 {
+		t.Errorf("expected exactly 1 list call; got %d", blocking.listCalls)
+	}
+}
+
+func TestCoalesceLeaderCanceled(t *testing.T) {
+	blocking := &blockingServiceInfo{
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+	blocking.services.Items = append(blocking.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service"},
+	})
+	coalescer := newCoalescingServiceInfo(blocking)
+	waiting := &atomic.Int32{}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err := coalescer.list(leaderCtx, listOptions{})
+		leaderErr <- err
+	}()
+	<-blocking.started
+
+	waiterErr := make(chan error)
+	go func() {
+		services, err := coalescer.list(waitCountingContext{context.Background(), waiting}, listOptions{})
+		if err == nil && len(services.Items) != 1 {
+			t.Errorf("waiter got %d services; expected 1", len(services.Items))
+		}
+		waiterErr <- err
+	}()
+	waitForCount(waiting, 1)
+
+	// the leader stops waiting, but the shared call continues for the waiter
+	cancelLeader()
+	if err := <-leaderErr; err != context.Canceled {
+		t.Errorf("leader err=%v; expected context.Canceled", err)
+	}
+	close(blocking.release)
+	if err := <-waiterErr; err != nil {
+		t.Errorf("waiter err=%v; expected the shared result", err)
+	}
+	if blocking.listCalls != 1 {
+		t.Errorf("expected exactly 1 list call; got %d", blocking.listCalls)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Reads a -config YAML file mapping flag names to values, and sets the flags that were not set on
+// the command line, so flags override the file. Lists are joined with commas, for flags like
+// -allowNamespaces. For example:
+//
+//	backendTimeout: 30s
+//	maxWebsockets: 100
+//	allowNamespaces: [team-a, team-b]
+func loadConfigFile(path string, flags *flag.FlagSet) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return err
+	}
+
+	setOnCommandLine := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	for name, value := range config {
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag %#v", name)
+		}
+		if setOnCommandLine[name] {
+			continue
+		}
+		flagValue, err := configFlagValue(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		err = flags.Set(name, flagValue)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Returns the flag string for a value decoded from YAML.
+func configFlagValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		// YAML is decoded as JSON, so all numbers are float64
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			itemValue, err := configFlagValue(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(itemValue, ",") {
+				return "", fmt.Errorf("list item %#v must not contain a comma", itemValue)
+			}
+			items[i] = itemValue
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %#v: must be a string, boolean, number, or list", value)
+}
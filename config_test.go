@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+backendTimeout: 30s
+maxWebsockets: 100
+allowIndexing: true
+allowNamespaces: [team-a, team-b]
+logFormat: json
+`)
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	backendTimeout := flags.Duration("backendTimeout", 0, "")
+	maxWebsockets := flags.Int("maxWebsockets", 0, "")
+	allowIndexing := flags.Bool("allowIndexing", false, "")
+	allowNamespaces := flags.String("allowNamespaces", "", "")
+	logFormat := flags.String("logFormat", "text", "")
+	err := flags.Parse([]string{"-logFormat=gcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = loadConfigFile(path, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *backendTimeout != 30*time.Second || *maxWebsockets != 100 || !*allowIndexing ||
+		*allowNamespaces != "team-a,team-b" {
+		t.Errorf("config not applied: backendTimeout=%s maxWebsockets=%d allowIndexing=%t allowNamespaces=%#v",
+			*backendTimeout, *maxWebsockets, *allowIndexing, *allowNamespaces)
+	}
+	// the command line overrides the file
+	if *logFormat != "gcp" {
+		t.Errorf("logFormat=%#v; expected the flag's value gcp", *logFormat)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		contents string
+		expected string
+	}{
+		{"unknownFlag: 1", "unknown flag"},
+		{"maxWebsockets: lots", "maxWebsockets"},
+		{"maxWebsockets: {a: 1}", "unsupported value"},
+		{"allowNamespaces: [a, 'b,c']", "comma"},
+		{"- not a map", "cannot unmarshal"},
+	}
+	for _, test := range tests {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		flags.Int("maxWebsockets", 0, "")
+		flags.String("allowNamespaces", "", "")
+		err := loadConfigFile(writeConfigFile(t, test.contents), flags)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%#v: err=%v; expected to contain %#v", test.contents, err, test.expected)
+		}
+	}
+
+	err := loadConfigFile(filepath.Join(t.TempDir(), "missing.yaml"), flag.NewFlagSet("test", flag.ContinueOnError))
+	if err == nil {
+		t.Error("loading a missing file should fail")
+	}
+}
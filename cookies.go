@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Returns the canonical SameSite attribute value for value, which is case-insensitive. The empty
+// string means backend cookies are not changed.
+func parseSameSite(value string) (string, error) {
+	for _, valid := range []string{"", "Lax", "Strict", "None"} {
+		if strings.EqualFold(value, valid) {
+			return valid, nil
+		}
+	}
+	return "", fmt.Errorf("invalid SameSite value %#v: must be Lax, Strict or None", value)
+}
+
+// Rewrites a Set-Cookie header value so it has the SameSite=sameSite attribute, replacing any
+// existing SameSite attribute. Browsers reject SameSite=None cookies without Secure, so it is
+// added in that case.
+func rewriteSetCookie(setCookie string, sameSite string) string {
+	if sameSite == "" {
+		return setCookie
+	}
+
+	parts := strings.Split(setCookie, ";")
+	out := parts[:1]
+	hasSecure := false
+	for _, attr := range parts[1:] {
+		name, _, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		if strings.EqualFold(name, "SameSite") {
+			continue
+		}
+		if strings.EqualFold(name, "Secure") {
+			hasSecure = true
+		}
+		out = append(out, attr)
+	}
+	out = append(out, " SameSite="+sameSite)
+	if sameSite == "None" && !hasSecure {
+		out = append(out, " Secure")
+	}
+	return strings.Join(out, ";")
+}
+
+// Rewrites the Path attribute of a Set-Cookie header value so absolute paths start with
+// rootPath. Otherwise the cookie would be sent to every service behind the proxy.
+func rewriteCookiePath(setCookie string, rootPath string) string {
+	parts := strings.Split(setCookie, ";")
+	for i, attr := range parts[1:] {
+		name, value, _ := strings.Cut(attr, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "Path") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, "/") {
+			parts[i+1] = name + "=" + rewriteURL(value, rootPath)
+		}
+	}
+	return strings.Join(parts, ";")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewriteSetCookie(t *testing.T) {
+	type testCase struct {
+		input    string
+		sameSite string
+		expected string
+	}
+	testCases := []testCase{
+		{"a=b; Path=/", "", "a=b; Path=/"},
+		{"a=b; Path=/", "Lax", "a=b; Path=/; SameSite=Lax"},
+		{"a=b; samesite=none; Path=/", "Strict", "a=b; Path=/; SameSite=Strict"},
+		{"a=b", "None", "a=b; SameSite=None; Secure"},
+		{"a=b; Secure", "None", "a=b; Secure; SameSite=None"},
+	}
+	for i, test := range testCases {
+		output := rewriteSetCookie(test.input, test.sameSite)
+		if output != test.expected {
+			t.Errorf("%d: rewriteSetCookie(%#v, %#v)=%#v; expected %#v",
+				i, test.input, test.sameSite, output, test.expected)
+		}
+	}
+
+	for _, valid := range []string{"", "lax", "STRICT", "None"} {
+		if _, err := parseSameSite(valid); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := parseSameSite("sometimes"); err == nil {
+		t.Error("parseSameSite must reject invalid values")
+	}
+}
+
+func TestRewriteCookiePath(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"a=b; Path=/admin", "a=b; Path=/ns/svc/80/admin"},
+		{"a=b; path=/; HttpOnly", "a=b; path=/ns/svc/80/; HttpOnly"},
+		{"a=b; Domain=example.com; Path=/x; Secure", "a=b; Domain=example.com; Path=/ns/svc/80/x; Secure"},
+		{"a=b; Path=/ns/svc/80/admin", "a=b; Path=/ns/svc/80/admin"},
+		{"a=b", "a=b"},
+		{"path=/value", "path=/value"},
+	}
+	for i, test := range testCases {
+		output := rewriteCookiePath(test.input, "/ns/svc/80")
+		if output != test.expected {
+			t.Errorf("%d: rewriteCookiePath(%#v)=%#v; expected %#v", i, test.input, output, test.expected)
+		}
+	}
+}
+
+func TestProxyCookiePath(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=secret; Path=/admin; Domain=example.com")
+	}))
+	kwp := newServer(fakeAPI)
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	expected := fmt.Sprintf("session=secret; Path=/namespace/service/%d/admin; Domain=example.com", port)
+	if recorder.Header().Get("Set-Cookie") != expected {
+		t.Errorf("Set-Cookie=%#v; expected %#v", recorder.Header().Get("Set-Cookie"), expected)
+	}
+}
+
+func TestProxyCookieSameSite(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=secret; Path=/")
+		w.Header().Add("Set-Cookie", "other=value; SameSite=Strict")
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.cookieSameSite = "Lax"
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	cookies := recorder.Header().Values("Set-Cookie")
+	expected := []string{fmt.Sprintf("session=secret; Path=/namespace/service/%d/; SameSite=Lax", port),
+		"other=value; SameSite=Lax"}
+	if len(cookies) != len(expected) {
+		t.Fatalf("Set-Cookie=%#v; expected %#v", cookies, expected)
+	}
+	for i := range expected {
+		if cookies[i] != expected[i] {
+			t.Errorf("Set-Cookie[%d]=%#v; expected %#v", i, cookies[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"regexp"
+)
+
+// Matches CSS url() references, with the URL in group 1 (double quoted), 2 (single quoted), or
+// 3 (unquoted).
+var cssURLPattern = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^"'()\s]*))\s*\)`)
+
+// Rewrites the URLs in url() references in css, as found in <style> elements and style
+// attributes, so absolute paths start with rootPath. data: URLs are not rewritten by rewriteURL.
+func rewriteCSSURLs(css string, rootPath string) string {
+	return cssURLPattern.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssURLPattern.FindStringSubmatchIndex(match)
+		for group := 1; group <= 3; group++ {
+			start, end := groups[2*group], groups[2*group+1]
+			if start < 0 {
+				continue
+			}
+			return match[:start] + rewriteURL(match[start:end], rootPath) + match[end:]
+		}
+		return match
+	})
+}
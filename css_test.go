@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRewriteCSSURLs(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`background: url(/img/bg.png)`, `background: url(/root/img/bg.png)`},
+		{`background: url("/img/bg.png")`, `background: url("/root/img/bg.png")`},
+		{`background: url('/img/bg.png')`, `background: url('/root/img/bg.png')`},
+		{`background: URL( /img/bg.png )`, `background: URL( /root/img/bg.png )`},
+		{`background: url(img/relative.png)`, `background: url(img/relative.png)`},
+		{`background: url(https://example.com/bg.png)`, `background: url(https://example.com/bg.png)`},
+		{`background: url(data:image/png;base64,iVBORw0KGgo=)`, `background: url(data:image/png;base64,iVBORw0KGgo=)`},
+		{`background: url("data:image/svg+xml;utf8,<svg/>")`, `background: url("data:image/svg+xml;utf8,<svg/>")`},
+		{`src: url(/a.woff2) format("woff2"), url(/a.woff)`, `src: url(/root/a.woff2) format("woff2"), url(/root/a.woff)`},
+	}
+	for i, test := range tests {
+		output := rewriteCSSURLs(test.input, "/root")
+		if output != test.expected {
+			t.Errorf("%d: rewriteCSSURLs(%#v)=%#v; expected %#v", i, test.input, output, test.expected)
+		}
+	}
+}
+
+func TestRewriteHTMLCSS(t *testing.T) {
+	const input = `<html><head><style>
+body { background: url("/img/bg.png"); }
+@font-face { src: url(/fonts/a.woff2) format("woff2"), url('/fonts/a.woff'); }
+.child > p { color: red; }
+</style></head>
+<body><div style="background-image: url(/img/div.png)">x</div>
+<p>url(/not/css.png)</p></body></html>`
+	out := &bytes.Buffer{}
+	err := rewriteAbsolutePathLinks(out, strings.NewReader(input), "/extra/path", rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustContain := []string{
+		`background: url("/extra/path/img/bg.png");`,
+		`src: url(/extra/path/fonts/a.woff2) format("woff2"), url('/extra/path/fonts/a.woff');`,
+		// CSS must not be escaped
+		`.child > p { color: red; }`,
+		`style="background-image: url(/extra/path/img/div.png)"`,
+		// text outside of <style> is not CSS
+		`<p>url(/not/css.png)</p>`,
+	}
+	for _, s := range mustContain {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("output must contain %#v\n%s", s, out.String())
+		}
+	}
+}
+
+func TestProxyRewritesCSS(t *testing.T) {
+	const css = `body { background: url(/img/bg.png); }
+@font-face { src: url("/fonts/a.woff2"), url('/fonts/a.woff'); }
+.logo { background: url(data:image/png;base64,AAAA); }`
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		w.Write([]byte(css))
+	}))
+	kwp := newServer(fakeAPI)
+
+	root := fmt.Sprintf("/namespace/service/%d/", port)
+	r := httptest.NewRequest(http.MethodGet, root+"static/app.css", nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	expected := "body { background: url(" + root + "img/bg.png); }\n" +
+		`@font-face { src: url("` + root + `fonts/a.woff2"), url('` + root + `fonts/a.woff'); }` + "\n" +
+		".logo { background: url(data:image/png;base64,AAAA); }"
+	if recorder.Body.String() != expected {
+		t.Errorf("rewritten CSS=\n%s\nexpected:\n%s", recorder.Body.String(), expected)
+	}
+	if recorder.Header().Get("Content-Length") != strconv.Itoa(len(expected)) {
+		t.Errorf("Content-Length=%#v; expected %d", recorder.Header().Get("Content-Length"), len(expected))
+	}
+}
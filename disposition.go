@@ -0,0 +1,67 @@
+package main
+
+import (
+	"mime"
+	"regexp"
+	"strings"
+)
+
+// Matches a filename parameter, which mime.ParseMediaType rejects if it is unquoted and contains
+// a slash, as in "attachment; filename=/reports/x.pdf": submatch 1 is the quoted or unquoted value.
+var filenameParamPattern = regexp.MustCompile(`(?i);\s*filename\s*=\s*("[^"]*"|[^;]*)`)
+
+// Returns the last path segment of filename, or "" if it ends with a separator.
+func baseFilename(filename string) string {
+	return filename[strings.LastIndexAny(filename, `/\`)+1:]
+}
+
+// Returns the Content-Disposition header value with the directories removed from the filename,
+// so a download cannot reveal the backend's paths. Browsers also strip them, but not all clients
+// do. Returns value unchanged if its filename has no directories.
+func sanitizeContentDisposition(value string) string {
+	disposition, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return sanitizeInvalidContentDisposition(value)
+	}
+	filename, ok := params["filename"]
+	if !ok || !strings.ContainsAny(filename, `/\`) {
+		return value
+	}
+
+	if base := baseFilename(filename); base != "" {
+		params["filename"] = base
+	} else {
+		delete(params, "filename")
+	}
+	sanitized := mime.FormatMediaType(disposition, params)
+	if sanitized == "" {
+		// should not happen: the parameters were parsed from a valid header
+		return value
+	}
+	return sanitized
+}
+
+// Rewrites the filename parameter of a header that mime.ParseMediaType cannot parse.
+func sanitizeInvalidContentDisposition(value string) string {
+	match := filenameParamPattern.FindStringSubmatchIndex(value)
+	if match == nil {
+		return value
+	}
+	filename := strings.TrimSpace(value[match[2]:match[3]])
+	quoted := len(filename) >= 2 && filename[0] == '"'
+	if quoted {
+		filename = filename[1 : len(filename)-1]
+	}
+	if !strings.ContainsAny(filename, `/\`) {
+		return value
+	}
+
+	base := baseFilename(filename)
+	if base == "" {
+		return value[:match[0]] + value[match[1]:]
+	}
+	if quoted || strings.ContainsAny(base, " \t") {
+		base = `"` + base + `"`
+	}
+	return value[:match[2]] + base + value[match[3]:]
+}
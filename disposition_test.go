@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSanitizeContentDisposition(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"attachment; filename=/reports/x.pdf", "attachment; filename=x.pdf"},
+		{`attachment; filename="C:\reports\x.pdf"`, "attachment; filename=x.pdf"},
+		{`attachment; filename="/reports/my report.pdf"`, `attachment; filename="my report.pdf"`},
+		{"attachment; filename*=UTF-8''%2Fdir%2Fna%C3%AFve.txt", "attachment; filename*=utf-8''na%C3%AFve.txt"},
+		{"attachment; filename=/reports/", "attachment"},
+		// unchanged
+		{"attachment; filename=x.pdf", "attachment; filename=x.pdf"},
+		{`attachment; filename="x.pdf"`, `attachment; filename="x.pdf"`},
+		{"inline", "inline"},
+		{"attachment; filename=", "attachment; filename="},
+	}
+	for _, test := range tests {
+		output := sanitizeContentDisposition(test.input)
+		if output != test.expected {
+			t.Errorf("sanitizeContentDisposition(%#v)=%#v; expected %#v", test.input, output, test.expected)
+		}
+	}
+}
+
+func TestProxyContentDisposition(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", "attachment; filename=/var/reports/x.pdf")
+	}))
+	kwp := newServer(fakeAPI)
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/report", port), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Header().Get("Content-Disposition") != "attachment; filename=x.pdf" {
+		t.Errorf("Content-Disposition=%#v", recorder.Header().Get("Content-Disposition"))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Replaces resp.Body with its decoded contents if it has a Content-Encoding, so it can be
+// rewritten. The response is sent to the client uncompressed. Returns false without changing
+// resp if the encoding is not supported.
+func (s *server) decodeResponseBody(resp *http.Response) (bool, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	var decoded io.ReadCloser
+	var err error
+	switch encoding {
+	case "", "identity":
+		return true, nil
+	case "gzip", "x-gzip":
+		decoded, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		// HTTP's deflate is the zlib format
+		decoded, err = zlib.NewReader(resp.Body)
+	default:
+		s.logger.info("not rewriting body with unsupported Content-Encoding", logFields{"encoding": encoding})
+		return false, nil
+	}
+	if err == io.EOF {
+		// empty body, e.g. a response to HEAD
+		decoded = http.NoBody
+	} else if err != nil {
+		return false, err
+	}
+
+	resp.Body = &decodedBody{decoded, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return true, nil
+}
+
+// Closes both the decoder and the original body.
+type decodedBody struct {
+	io.ReadCloser
+	original io.ReadCloser
+}
+
+func (d *decodedBody) Close() error {
+	d.ReadCloser.Close()
+	return d.original.Close()
+}
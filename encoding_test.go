@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProxyDecodesCompressedHTML(t *testing.T) {
+	compressed := map[string][]byte{}
+	gzipped := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(gzipped)
+	gzipWriter.Write([]byte(exampleHTML))
+	gzipWriter.Close()
+	compressed["gzip"] = gzipped.Bytes()
+	deflated := &bytes.Buffer{}
+	zlibWriter := zlib.NewWriter(deflated)
+	zlibWriter.Write([]byte(exampleHTML))
+	zlibWriter.Close()
+	compressed["deflate"] = deflated.Bytes()
+	compressed["br"] = []byte("not really brotli")
+
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.URL.Query().Get("encoding")
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Set("Content-Length", strconv.Itoa(len(compressed[encoding])))
+		w.Write(compressed[encoding])
+	}))
+	kwp := newServer(fakeAPI)
+
+	root := fmt.Sprintf("/namespace/service/%d/", port)
+	for _, encoding := range []string{"gzip", "deflate"} {
+		r := httptest.NewRequest(http.MethodGet, root+"?encoding="+encoding, nil)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: Content-Encoding=%#v; expected it to be removed",
+				encoding, recorder.Header().Get("Content-Encoding"))
+		}
+		if recorder.Header().Get("Content-Length") != strconv.Itoa(recorder.Body.Len()) {
+			t.Errorf("%s: Content-Length=%#v; expected the decoded length %d",
+				encoding, recorder.Header().Get("Content-Length"), recorder.Body.Len())
+		}
+		expected := fmt.Sprintf(`"%srootrelative"`, root)
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("%s: output should contain %#v:\n%s", encoding, expected, recorder.Body.String())
+		}
+	}
+
+	// unsupported encodings are passed through unmodified
+	r := httptest.NewRequest(http.MethodGet, root+"?encoding=br", nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	body, _ := io.ReadAll(recorder.Body)
+	if recorder.Header().Get("Content-Encoding") != "br" || !bytes.Equal(body, compressed["br"]) {
+		t.Errorf("br: Content-Encoding=%#v body=%#v; expected unmodified",
+			recorder.Header().Get("Content-Encoding"), string(body))
+	}
+}
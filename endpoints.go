@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Reads the endpoints of services, to connect to headless services (without a ClusterIP), or to
+// all services with -directEndpoints.
+type endpointInfo interface {
+	listEndpointSlices(ctx context.Context, namespace string, service string) ([]discoveryv1.EndpointSlice, error)
+	getEndpoints(ctx context.Context, namespace string, service string) (*corev1.Endpoints, error)
+}
+
+func (k *kubernetesAPIClient) listEndpointSlices(
+	ctx context.Context, namespace string, service string,
+) ([]discoveryv1.EndpointSlice, error) {
+	slices, err := k.clientset.DiscoveryV1().EndpointSlices(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + service,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slices.Items, nil
+}
+
+func (k *kubernetesAPIClient) getEndpoints(ctx context.Context, namespace string, service string) (*corev1.Endpoints, error) {
+	return k.clientset.CoreV1().Endpoints(namespace).Get(ctx, service, metav1.GetOptions{})
+}
+
+// Returns true if service has no ClusterIP, so it can only be reached through its endpoints.
+func isHeadless(service *corev1.Service) bool {
+	return service.Spec.ClusterIP == "" || service.Spec.ClusterIP == corev1.ClusterIPNone
+}
+
+// Returns the host:port to connect to for port of service: a ready endpoint if the service is
+// headless or -directEndpoints is set, otherwise backendAddr.
+func (s *server) resolveBackendAddr(ctx context.Context, service *corev1.Service, port int64) (string, error) {
+	if s.endpoints != nil && (s.directEndpoints || isHeadless(service)) {
+		return resolveEndpoint(ctx, s.endpoints, service, port)
+	}
+	return s.backendAddr(service, port)
+}
+
+// Returns the host:port of a random ready endpoint for port of service. This reads
+// EndpointSlices, falling back to the legacy Endpoints API if the service has none, e.g. on old
+// clusters or for endpoints managed by hand.
+func resolveEndpoint(ctx context.Context, info endpointInfo, service *corev1.Service, port int64) (string, error) {
+	var servicePort *corev1.ServicePort
+	for i := range service.Spec.Ports {
+		if int64(service.Spec.Ports[i].Port) == port && service.Spec.Ports[i].Protocol == corev1.ProtocolTCP {
+			servicePort = &service.Spec.Ports[i]
+			break
+		}
+	}
+	if servicePort == nil {
+		return "", &statusError{http.StatusNotFound, fmt.Sprintf(
+			"service %s/%s has no TCP port %d", service.Namespace, service.Name, port)}
+	}
+
+	slices, err := info.listEndpointSlices(ctx, service.Namespace, service.Name)
+	if err != nil && !errors.IsNotFound(err) {
+		return "", err
+	}
+	var addrs []string
+	if len(slices) > 0 {
+		addrs = readySliceAddrs(slices, servicePort.Name)
+	} else {
+		endpoints, err := info.getEndpoints(ctx, service.Namespace, service.Name)
+		if err != nil && !errors.IsNotFound(err) {
+			return "", err
+		}
+		if endpoints != nil {
+			addrs = readyEndpointsAddrs(endpoints, servicePort.Name)
+		}
+	}
+	if len(addrs) == 0 {
+		return "", &statusError{http.StatusServiceUnavailable, fmt.Sprintf(
+			"service %s/%s has no ready endpoints for port %d", service.Namespace, service.Name, port)}
+	}
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
+// Returns host:port of the ready endpoints in slices for the service port named portName.
+func readySliceAddrs(slices []discoveryv1.EndpointSlice, portName string) []string {
+	var addrs []string
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+		var targetPort int32
+		for _, p := range slice.Ports {
+			name := ""
+			if p.Name != nil {
+				name = *p.Name
+			}
+			isTCP := p.Protocol == nil || *p.Protocol == corev1.ProtocolTCP
+			if name == portName && isTCP && p.Port != nil {
+				targetPort = *p.Port
+				break
+			}
+		}
+		if targetPort == 0 {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			// a nil Ready condition means unknown, which consumers should treat as ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, addr := range endpoint.Addresses {
+				addrs = append(addrs, net.JoinHostPort(addr, strconv.Itoa(int(targetPort))))
+			}
+		}
+	}
+	return addrs
+}
+
+// Returns host:port of the ready addresses in endpoints for the service port named portName.
+func readyEndpointsAddrs(endpoints *corev1.Endpoints, portName string) []string {
+	var addrs []string
+	for _, subset := range endpoints.Subsets {
+		var targetPort int32
+		for _, p := range subset.Ports {
+			if p.Name == portName && (p.Protocol == "" || p.Protocol == corev1.ProtocolTCP) {
+				targetPort = p.Port
+				break
+			}
+		}
+		if targetPort == 0 {
+			continue
+		}
+		for _, addr := range subset.Addresses {
+			addrs = append(addrs, net.JoinHostPort(addr.IP, strconv.Itoa(int(targetPort))))
+		}
+	}
+	return addrs
+}
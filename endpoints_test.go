@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type fakeEndpointClient struct {
+	slices    []discoveryv1.EndpointSlice
+	endpoints *corev1.Endpoints
+}
+
+func (f *fakeEndpointClient) listEndpointSlices(
+	ctx context.Context, namespace string, service string,
+) ([]discoveryv1.EndpointSlice, error) {
+	var out []discoveryv1.EndpointSlice
+	for _, slice := range f.slices {
+		if slice.Namespace == namespace && slice.Labels[discoveryv1.LabelServiceName] == service {
+			out = append(out, slice)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeEndpointClient) getEndpoints(ctx context.Context, namespace string, service string) (*corev1.Endpoints, error) {
+	if f.endpoints == nil || f.endpoints.Namespace != namespace || f.endpoints.Name != service {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "endpoints"}, service)
+	}
+	return f.endpoints, nil
+}
+
+func newTestEndpointSlice(name string, portName string, port int32, addrs map[string]bool) discoveryv1.EndpointSlice {
+	slice := discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: name,
+			Labels: map[string]string{discoveryv1.LabelServiceName: "service"}},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+	for addr, ready := range addrs {
+		ready := ready
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{addr},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		})
+	}
+	return slice
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service"},
+		Spec: corev1.ServiceSpec{ClusterIP: corev1.ClusterIPNone, Ports: []corev1.ServicePort{
+			{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+			{Name: "admin", Protocol: corev1.ProtocolTCP, Port: 9000},
+		}},
+	}
+	ctx := context.Background()
+
+	// the service port is mapped to the endpoint's port, and not ready endpoints are skipped
+	info := &fakeEndpointClient{slices: []discoveryv1.EndpointSlice{
+		newTestEndpointSlice("admin", "admin", 9090, map[string]bool{"10.0.0.9": true}),
+		newTestEndpointSlice("http", "http", 8080, map[string]bool{"10.0.0.1": false, "10.0.0.2": true}),
+	}}
+	for i := 0; i < 10; i++ {
+		addr, err := resolveEndpoint(ctx, info, service, 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != "10.0.0.2:8080" {
+			t.Fatalf("addr=%#v; expected the ready endpoint 10.0.0.2:8080", addr)
+		}
+	}
+	addr, err := resolveEndpoint(ctx, info, service, 9000)
+	if err != nil || addr != "10.0.0.9:9090" {
+		t.Errorf("port 9000: addr=%#v err=%v; expected 10.0.0.9:9090", addr, err)
+	}
+
+	// a nil ready condition is treated as ready
+	info.slices[1].Endpoints[0].Conditions.Ready = nil
+	info.slices[1].Endpoints[1].Conditions.Ready = nil
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		addr, err := resolveEndpoint(ctx, info, service, 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[addr] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected both endpoints to be used: %v", seen)
+	}
+
+	// without slices, the legacy Endpoints are used
+	info = &fakeEndpointClient{endpoints: &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses:         []corev1.EndpointAddress{{IP: "10.0.0.3"}},
+			NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.4"}},
+			Ports:             []corev1.EndpointPort{{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP}},
+		}},
+	}}
+	addr, err = resolveEndpoint(ctx, info, service, 80)
+	if err != nil || addr != "10.0.0.3:8080" {
+		t.Errorf("Endpoints fallback: addr=%#v err=%v; expected 10.0.0.3:8080", addr, err)
+	}
+
+	// no ready endpoints
+	info = &fakeEndpointClient{slices: []discoveryv1.EndpointSlice{
+		newTestEndpointSlice("http", "http", 8080, map[string]bool{"10.0.0.1": false}),
+	}}
+	_, err = resolveEndpoint(ctx, info, service, 80)
+	if statusErr, ok := err.(*statusError); !ok || statusErr.code != http.StatusServiceUnavailable {
+		t.Errorf("no ready endpoints: err=%#v; expected 503", err)
+	}
+	_, err = resolveEndpoint(ctx, &fakeEndpointClient{}, service, 80)
+	if statusErr, ok := err.(*statusError); !ok || statusErr.code != http.StatusServiceUnavailable {
+		t.Errorf("no endpoints: err=%#v; expected 503", err)
+	}
+}
+
+func TestProxyHeadlessService(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path=%s", r.URL.Path)
+	}))
+	// the service port differs from the backend port, which is only known from the endpoints
+	fakeAPI.services.Items[0].Spec.ClusterIP = corev1.ClusterIPNone
+	fakeAPI.services.Items[0].Spec.Ports[0].Port = 80
+	s := newServer(fakeAPI)
+	s.endpoints = &fakeEndpointClient{slices: []discoveryv1.EndpointSlice{
+		newTestEndpointSlice("slice", "", int32(port), map[string]bool{"127.0.0.1": true}),
+	}}
+
+	r := httptest.NewRequest(http.MethodGet, "/namespace/service/80/dir", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "path=/dir" {
+		t.Errorf("status=%d body=%#v; expected 200 path=/dir", recorder.Code, recorder.Body.String())
+	}
+}
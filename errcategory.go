@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	stderrors "errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Category of an error connecting to a backend or looking up a service, so errors can be
+// aggregated without parsing error strings.
+type errorCategory string
+
+const (
+	errorCategoryTimeout           errorCategory = "timeout"
+	errorCategoryConnectionRefused errorCategory = "connection-refused"
+	errorCategoryDNS               errorCategory = "dns"
+	errorCategoryTLS               errorCategory = "tls"
+	errorCategoryForbidden         errorCategory = "forbidden"
+	errorCategoryNotFound          errorCategory = "not-found"
+	errorCategoryOther             errorCategory = "other"
+)
+
+// Proxy-Status error types from RFC 9209 for each category.
+var proxyStatusErrorTypes = map[errorCategory]string{
+	errorCategoryTimeout:           "connection_timeout",
+	errorCategoryConnectionRefused: "connection_refused",
+	errorCategoryDNS:               "dns_error",
+	errorCategoryTLS:               "tls_certificate_error",
+	errorCategoryForbidden:         "http_request_denied",
+	errorCategoryNotFound:          "destination_not_found",
+	errorCategoryOther:             "proxy_internal_error",
+}
+
+// Response header describing proxy errors; see RFC 9209.
+const proxyStatusHeader = "Proxy-Status"
+
+func classifyError(err error) errorCategory {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var statusErr *statusError
+	var recordHeaderErr tls.RecordHeaderError
+	var certVerificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+	switch {
+	case err == nil:
+		return ""
+	case stderrors.As(err, &dnsErr):
+		// checked before timeouts: DNS errors can also be timeouts
+		return errorCategoryDNS
+	case stderrors.Is(err, context.DeadlineExceeded),
+		stderrors.As(err, &netErr) && netErr.Timeout():
+		return errorCategoryTimeout
+	case stderrors.Is(err, syscall.ECONNREFUSED):
+		return errorCategoryConnectionRefused
+	case stderrors.As(err, &recordHeaderErr), stderrors.As(err, &certVerificationErr),
+		stderrors.As(err, &unknownAuthorityErr), stderrors.As(err, &hostnameErr),
+		stderrors.As(err, &certInvalidErr):
+		return errorCategoryTLS
+	case errors.IsForbidden(err),
+		stderrors.As(err, &statusErr) && statusErr.code == http.StatusForbidden:
+		return errorCategoryForbidden
+	case errors.IsNotFound(err),
+		stderrors.As(err, &statusErr) && statusErr.code == http.StatusNotFound:
+		return errorCategoryNotFound
+	}
+	return errorCategoryOther
+}
+
+// Returns the Proxy-Status header value for err, with its category as the details.
+func proxyStatus(err error) string {
+	category := classifyError(err)
+	return fmt.Sprintf("kubewebproxy; error=%s; details=%q", proxyStatusErrorTypes[category], category)
+}
+
+// Handles errors from ReverseProxy, which are errors connecting to or reading from backends.
+// Timeouts return 504 Gateway Timeout; other errors return 502 Bad Gateway, except a statusError
+// returned by a transport, which returns its code.
+func (s *server) proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	category := classifyError(err)
+	s.logger.warning("backend error", logFields{"url": redactURL(r.URL, s.redactQueryParams),
+		"category": string(category), "error": err.Error()})
+	w.Header().Set(proxyStatusHeader, proxyStatus(err))
+	var statusErr *statusError
+	if stderrors.As(err, &statusErr) {
+		http.Error(w, statusErr.message, statusErr.code)
+		return
+	}
+	if category == errorCategoryTimeout {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
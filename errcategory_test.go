@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	urlError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://backend/", Err: err}
+	}
+	testCases := []struct {
+		err      error
+		expected errorCategory
+	}{
+		{nil, ""},
+		{urlError(&net.OpError{Op: "dial", Err: timeoutError{}}), errorCategoryTimeout},
+		{fmt.Errorf("proxy: %w", context.DeadlineExceeded), errorCategoryTimeout},
+		{urlError(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}),
+			errorCategoryConnectionRefused},
+		{urlError(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "backend", IsNotFound: true}}),
+			errorCategoryDNS},
+		{urlError(&net.DNSError{Err: "timeout", Name: "backend", IsTimeout: true}), errorCategoryDNS},
+		{urlError(x509.UnknownAuthorityError{}), errorCategoryTLS},
+		{urlError(x509.HostnameError{Host: "backend"}), errorCategoryTLS},
+		{errors.NewForbidden(schema.GroupResource{Resource: "services"}, "svc", fmt.Errorf("denied")),
+			errorCategoryForbidden},
+		{&statusError{http.StatusForbidden, "namespace cannot be proxied"}, errorCategoryForbidden},
+		{errors.NewNotFound(schema.GroupResource{Resource: "services"}, "svc"), errorCategoryNotFound},
+		{&statusError{http.StatusNotFound, "port not found"}, errorCategoryNotFound},
+		{&statusError{http.StatusBadRequest, "no TCP ports"}, errorCategoryOther},
+		{urlError(io.ErrUnexpectedEOF), errorCategoryOther},
+	}
+	for i, test := range testCases {
+		category := classifyError(test.err)
+		if category != test.expected {
+			t.Errorf("%d: classifyError(%v)=%#v; expected %#v", i, test.err, category, test.expected)
+		}
+	}
+}
+
+func TestProxyStatusHeader(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// nothing listens on the service's other port
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedPort := closed.Listener.Addr().(*net.TCPAddr).Port
+	closed.Close()
+	fakeAPI.services.Items[0].Spec.Ports = append(fakeAPI.services.Items[0].Spec.Ports,
+		fakeAPI.services.Items[0].Spec.Ports[0])
+	fakeAPI.services.Items[0].Spec.Ports[1].Port = int32(closedPort)
+	kwp := newServer(fakeAPI)
+
+	testCases := []struct {
+		path     string
+		code     int
+		expected string
+	}{
+		{fmt.Sprintf("/namespace/service/%d/", closedPort), http.StatusBadGateway,
+			`kubewebproxy; error=connection_refused; details="connection-refused"`},
+		{fmt.Sprintf("/namespace/missing/%d/", port), http.StatusNotFound,
+			`kubewebproxy; error=destination_not_found; details="not-found"`},
+		{fmt.Sprintf("/namespace/service/%d/", port), http.StatusOK, ""},
+	}
+	for _, test := range testCases {
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if recorder.Code != test.code || recorder.Header().Get(proxyStatusHeader) != test.expected {
+			t.Errorf("%s: status=%d Proxy-Status=%#v; expected %d %#v", test.path, recorder.Code,
+				recorder.Header().Get(proxyStatusHeader), test.code, test.expected)
+		}
+		if test.code == http.StatusBadGateway && strings.Contains(recorder.Body.String(), "refused") {
+			t.Errorf("%s: backend errors must not be returned to clients: %s", test.path, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// Substrings of user agents that are sent plain text errors: crawlers do not need pretty pages.
+var robotUserAgents = []string{"bot", "crawler", "spider"}
+
+// Message for unexpected errors. Their details, which can describe the Kubernetes API, RBAC, or
+// backend connections, are only logged.
+const internalErrorMessage = "internal error; see the proxy logs for details"
+
+type errorTemplateData struct {
+	Code       int
+	StatusText string
+	Message    string
+	BasePath   string
+}
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!doctype html>
+<html>
+<head><title>Kube Web Proxy: {{.Code}} {{.StatusText}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 40em; }
+.code { color: #b00; }
+</style>
+</head>
+<body>
+<h1><span class="code">{{.Code}}</span> {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+<p><a href="{{.BasePath}}/">Back to the service list</a></p>
+</body>
+</html>
+`))
+
+// Returns true if the error for r should be plain text: health checks, robots, and clients that
+// do not accept HTML, such as curl and API clients.
+func wantsPlainTextError(r *http.Request) bool {
+	lowerUserAgent := strings.ToLower(r.UserAgent())
+	for _, agent := range healthCheckUserAgents {
+		if strings.Contains(lowerUserAgent, agent) {
+			return true
+		}
+	}
+	for _, agent := range robotUserAgents {
+		if strings.Contains(lowerUserAgent, agent) {
+			return true
+		}
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		if strings.Contains(accept, "text/html") {
+			return false
+		}
+	}
+	return true
+}
+
+// Writes an error response like http.Error, but as an HTML page with a link back to the service
+// list for browsers.
+func (s *server) writeError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	if wantsPlainTextError(r) {
+		http.Error(w, message, code)
+		return
+	}
+
+	// remove headers that http.Error also removes: they describe the response we are replacing
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	errorTemplate.Execute(w, &errorTemplateData{code, http.StatusText(code), message, s.basePath})
+}
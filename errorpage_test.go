@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestErrorPage(t *testing.T) {
+	s := newServer(&fakeKubernetesAPIClient{})
+
+	const browserAccept = "text/html,application/xhtml+xml,*/*;q=0.8"
+	tests := []struct {
+		path      string
+		userAgent string
+		accept    string
+		code      int
+		html      bool
+	}{
+		{"/missing", "Mozilla/5.0", browserAccept, http.StatusNotFound, true},
+		{"/namespace/missing/80/", "Mozilla/5.0", browserAccept, http.StatusNotFound, true},
+		{"/namespace/missing/80/", "curl/7.64.1", "*/*", http.StatusNotFound, false},
+		{"/namespace/missing/80/", "Googlebot/2.1", browserAccept, http.StatusNotFound, false},
+		{"/missing", "kube-probe/1.20", browserAccept, http.StatusNotFound, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r.Header.Set("User-Agent", test.userAgent)
+		r.Header.Set("Accept", test.accept)
+		recorder := httptest.NewRecorder()
+		s.rootHandler(recorder, r)
+		if recorder.Code != test.code {
+			t.Errorf("%s %s: status=%d; expected %d", test.path, test.userAgent, recorder.Code, test.code)
+		}
+		contentType := recorder.Header().Get("Content-Type")
+		body := recorder.Body.String()
+		if test.html {
+			if !strings.HasPrefix(contentType, "text/html") {
+				t.Errorf("%s %s: Content-Type=%#v; expected HTML", test.path, test.userAgent, contentType)
+			}
+			for _, expected := range []string{http.StatusText(test.code), `<a href="/">`} {
+				if !strings.Contains(body, expected) {
+					t.Errorf("%s %s: body=%#v; expected to contain %#v", test.path, test.userAgent, body, expected)
+				}
+			}
+		} else {
+			if !strings.HasPrefix(contentType, "text/plain") {
+				t.Errorf("%s %s: Content-Type=%#v; expected plain text", test.path, test.userAgent, contentType)
+			}
+			if strings.Contains(body, "<") {
+				t.Errorf("%s %s: body=%#v; expected plain text", test.path, test.userAgent, body)
+			}
+		}
+	}
+}
+
+func TestErrorPageEscapesMessage(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "text/html")
+	recorder := httptest.NewRecorder()
+	newServer(&fakeKubernetesAPIClient{}).writeError(recorder, r, "<script>bad</script>", http.StatusInternalServerError)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status=%d", recorder.Code)
+	}
+	body := recorder.Body.String()
+	if strings.Contains(body, "<script>") || !strings.Contains(body, "&lt;script&gt;bad") {
+		t.Errorf("message not escaped: %#v", body)
+	}
+	if !strings.Contains(body, "Internal Server Error") {
+		t.Errorf("body=%#v; expected status text", body)
+	}
+}
+
+type errorServiceInfo struct {
+	fakeKubernetesAPIClient
+	err error
+}
+
+func (e *errorServiceInfo) list(ctx context.Context, opts listOptions) (*corev1.ServiceList, error) {
+	return nil, e.err
+}
+
+func (e *errorServiceInfo) get(ctx context.Context, namespace string, name string) (*corev1.Service, error) {
+	return nil, e.err
+}
+
+func TestErrorPageHidesInternalErrors(t *testing.T) {
+	const internalDetail = "dial tcp 10.0.0.1:443: connect: connection refused"
+	s := newServer(&errorServiceInfo{err: stderrors.New(internalDetail)})
+
+	for _, path := range []string{"/", "/namespace/service/80/"} {
+		for _, accept := range []string{"text/html", "*/*"} {
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			r.Header.Set("Accept", accept)
+			recorder := httptest.NewRecorder()
+			s.rootHandler(recorder, r)
+			if recorder.Code != http.StatusInternalServerError {
+				t.Errorf("%s %s: status=%d; expected 500", path, accept, recorder.Code)
+			}
+			body := recorder.Body.String()
+			if strings.Contains(body, internalDetail) || !strings.Contains(body, internalErrorMessage) {
+				t.Errorf("%s %s: body=%#v; expected only the generic message", path, accept, body)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Source ranges of Google Cloud load balancers, which set X-Forwarded-For and X-Forwarded-Proto:
+// https://cloud.google.com/load-balancing/docs/https#source_ip_addresses
+const defaultTrustedProxyCIDRs = "130.211.0.0/22,35.191.0.0/16"
+
+var defaultTrustedProxies = mustParseCIDRList(defaultTrustedProxyCIDRs)
+
+// Parses a comma-separated list of CIDRs (e.g. 10.0.0.0/8).
+func parseCIDRList(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range splitList(value) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %#v: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func mustParseCIDRList(value string) []*net.IPNet {
+	networks, err := parseCIDRList(value)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// Returns true if remoteAddr (host:port) is in one of networks.
+func isTrustedProxy(remoteAddr string, networks []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the Forwarded and X-Forwarded-* headers, so clients cannot spoof their address or
+// protocol. ReverseProxy then sets X-Forwarded-For to the real client address.
+func stripForwardedHeaders(header http.Header) {
+	for name := range header {
+		if name == "Forwarded" || strings.HasPrefix(name, "X-Forwarded-") {
+			header.Del(name)
+		}
+	}
+}
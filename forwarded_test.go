@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyStripsSpoofedForwardedHeaders(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Echo-X-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		w.Header().Set("Echo-X-Forwarded-Host", r.Header.Get("X-Forwarded-Host"))
+		w.Header().Set("Echo-Forwarded", r.Header.Get("Forwarded"))
+	}))
+	kwp := newServer(fakeAPI)
+
+	for _, test := range []struct {
+		remoteAddr  string
+		expectedXFF string
+	}{
+		// untrusted client: spoofed values are replaced by the client's address
+		{"192.0.2.1:1234", "192.0.2.1"},
+		// trusted load balancer: its value is kept and it is appended
+		{"35.191.1.2:1234", "1.2.3.4, 35.191.1.2"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-For", "1.2.3.4")
+		r.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+		r.Header.Set("Forwarded", "for=1.2.3.4")
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+
+		if recorder.Header().Get("Echo-X-Forwarded-For") != test.expectedXFF {
+			t.Errorf("%s: X-Forwarded-For=%#v; expected %#v",
+				test.remoteAddr, recorder.Header().Get("Echo-X-Forwarded-For"), test.expectedXFF)
+		}
+		trusted := test.remoteAddr != "192.0.2.1:1234"
+		if (recorder.Header().Get("Echo-X-Forwarded-Host") != "") != trusted {
+			t.Errorf("%s: X-Forwarded-Host=%#v", test.remoteAddr, recorder.Header().Get("Echo-X-Forwarded-Host"))
+		}
+		if (recorder.Header().Get("Echo-Forwarded") != "") != trusted {
+			t.Errorf("%s: Forwarded=%#v", test.remoteAddr, recorder.Header().Get("Echo-Forwarded"))
+		}
+	}
+}
+
+func TestParseCIDRList(t *testing.T) {
+	networks, err := parseCIDRList(" 10.0.0.0/8, 2001:db8::/32 ")
+	if err != nil || len(networks) != 2 {
+		t.Fatalf("parseCIDRList=%v, %v", networks, err)
+	}
+	if !isTrustedProxy("10.1.2.3:80", networks) || !isTrustedProxy("[2001:db8::1]:80", networks) {
+		t.Error("addresses in the networks should be trusted")
+	}
+	if isTrustedProxy("11.0.0.1:80", networks) || isTrustedProxy("invalid", networks) {
+		t.Error("addresses outside the networks must not be trusted")
+	}
+	if _, err := parseCIDRList("10.0.0.0"); err == nil {
+		t.Error("parseCIDRList must reject addresses without a prefix length")
+	}
+}
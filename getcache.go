@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Wraps a serviceInfo to reuse the result of get for ttl, so proxying many requests to a service
+// does not make an API call for each one. Services may be stale for up to ttl after they change.
+type getCachingServiceInfo struct {
+	serviceInfo
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[[2]string]cachedService
+}
+
+type cachedService struct {
+	service *corev1.Service
+	expires time.Time
+}
+
+func newGetCachingServiceInfo(services serviceInfo, ttl time.Duration) *getCachingServiceInfo {
+	return &getCachingServiceInfo{
+		serviceInfo: services,
+		ttl:         ttl,
+		now:         time.Now,
+		entries:     map[[2]string]cachedService{},
+	}
+}
+
+func (c *getCachingServiceInfo) get(ctx context.Context, namespace string, name string) (*corev1.Service, error) {
+	key := [2]string{namespace, name}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.service.DeepCopy(), nil
+	}
+
+	// errors are not cached: a service that was not found may be created at any time
+	service, err := c.serviceInfo.get(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// remove expired entries so deleted services do not stay in memory
+	for otherKey, other := range c.entries {
+		if !now.Before(other.expires) {
+			delete(c.entries, otherKey)
+		}
+	}
+	c.entries[key] = cachedService{service.DeepCopy(), now.Add(c.ttl)}
+	return service, nil
+}
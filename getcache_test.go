@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+type countingServiceInfo struct {
+	serviceInfo
+	getCalls int
+}
+
+func (c *countingServiceInfo) get(ctx context.Context, namespace string, name string) (*corev1.Service, error) {
+	c.getCalls++
+	return c.serviceInfo.get(ctx, namespace, name)
+}
+
+func TestProxyGetCache(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	counter := &countingServiceInfo{serviceInfo: fakeAPI}
+	kwp := newServer(counter)
+	cache := newGetCachingServiceInfo(kwp.services, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	kwp.services = cache
+
+	proxyOnce := func() {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", recorder.Code, recorder.Body.String())
+		}
+	}
+	proxyOnce()
+	proxyOnce()
+	if counter.getCalls != 1 {
+		t.Errorf("two proxied requests made %d get calls; expected 1", counter.getCalls)
+	}
+
+	// after the TTL the service is fetched again
+	now = now.Add(time.Minute)
+	proxyOnce()
+	if counter.getCalls != 2 {
+		t.Errorf("get calls after expiry=%d; expected 2", counter.getCalls)
+	}
+
+	// errors are not cached
+	for i := 0; i < 2; i++ {
+		_, err := cache.get(context.Background(), "namespace", "missing")
+		if err == nil {
+			t.Fatal("get of a missing service should fail")
+		}
+	}
+	if counter.getCalls != 4 {
+		t.Errorf("get calls after errors=%d; expected 4", counter.getCalls)
+	}
+}
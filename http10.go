@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Service annotation that makes requests to the service use HTTP/1.0, for legacy backends that
+// do not understand HTTP/1.1. The only supported value is "1.0".
+const httpVersionAnnotation = "kubewebproxy.evanj/httpVersion"
+
+// Maximum size of a request body of unknown length sent with HTTP/1.0, which must be read to
+// determine its Content-Length. Larger bodies return 413 Request Entity Too Large.
+const http10MaxBufferedBody = 10 << 20
+
+// Sends requests using HTTP/1.0, with a new connection for each request. http.Transport always
+// uses HTTP/1.1, and can send bodies with chunked transfer encoding, which HTTP/1.0 does not have.
+type http10Transport struct {
+	dial dialFunc
+	// used for https backends; may be nil
+	tlsConfig *tls.Config
+	// if > 0, the maximum time to wait for the response headers after sending the request
+	responseHeaderTimeout time.Duration
+}
+
+// Returns a transport that connects to backends like backend, with the same dialer, TLS
+// configuration, and response header timeout. If backend is nil, it uses the defaults.
+func newHTTP10Transport(backend *http.Transport) *http10Transport {
+	if backend == nil {
+		backend = http.DefaultTransport.(*http.Transport)
+	}
+	t := &http10Transport{
+		dial:                  backend.DialContext,
+		tlsConfig:             backend.TLSClientConfig,
+		responseHeaderTimeout: backend.ResponseHeaderTimeout,
+	}
+	if t.dial == nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		t.dial = dialer.DialContext
+	}
+	return t
+}
+
+func (t *http10Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// HTTP/1.0 requires a Content-Length for bodies: stream bodies of known length, and read
+	// others to determine it
+	var body io.Reader
+	contentLength := req.ContentLength
+	if req.Body != nil {
+		defer req.Body.Close()
+		if contentLength >= 0 {
+			body = io.LimitReader(req.Body, contentLength)
+		} else {
+			buffered, err := io.ReadAll(io.LimitReader(req.Body, http10MaxBufferedBody+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(buffered) > http10MaxBufferedBody {
+				return nil, &statusError{http.StatusRequestEntityTooLarge, fmt.Sprintf(
+					"request bodies sent to HTTP/1.0 backends without a Content-Length are limited to %d bytes",
+					http10MaxBufferedBody)}
+			}
+			body = bytes.NewReader(buffered)
+			contentLength = int64(len(buffered))
+		}
+	}
+
+	header := req.Header.Clone()
+	for _, name := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length"} {
+		header.Del(name)
+	}
+	if contentLength > 0 {
+		header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	ctx := req.Context()
+	conn, err := t.dial(ctx, "tcp", req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme == "https" {
+		config := &tls.Config{}
+		if t.tlsConfig != nil {
+			config = t.tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = req.URL.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	// close the connection to abort blocked reads and writes if the request is cancelled
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	connBody := &http10ConnBody{conn: conn, done: done}
+
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "%s %s HTTP/1.0\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), host)
+	header.Write(writer)
+	writer.WriteString("\r\n")
+	if body != nil {
+		_, err = io.Copy(writer, body)
+		if err != nil {
+			connBody.Close()
+			return nil, err
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		connBody.Close()
+		return nil, err
+	}
+
+	if t.responseHeaderTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.responseHeaderTimeout))
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		connBody.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	connBody.ReadCloser = resp.Body
+	resp.Body = connBody
+	return resp, nil
+}
+
+// Closes the connection when the response body is closed.
+type http10ConnBody struct {
+	io.ReadCloser
+	conn   net.Conn
+	done   chan struct{}
+	closed bool
+}
+
+func (b *http10ConnBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	if b.ReadCloser != nil {
+		b.ReadCloser.Close()
+	}
+	return b.conn.Close()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProxyHTTP10(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Echo-Proto", r.Proto)
+		w.Header().Set("Echo-Transfer-Encoding", strings.Join(r.TransferEncoding, ","))
+		w.Header().Set("Echo-Body", string(body))
+		w.Write([]byte("response body"))
+	}))
+	kwp := newServer(fakeAPI)
+	path := fmt.Sprintf("/namespace/service/%d/", port)
+
+	for _, annotated := range []bool{false, true} {
+		if annotated {
+			fakeAPI.services.Items[0].Annotations = map[string]string{httpVersionAnnotation: "1.0"}
+		}
+		// a body of unknown length is sent chunked with HTTP/1.1
+		r := httptest.NewRequest(http.MethodPost, path, io.MultiReader(strings.NewReader("request body")))
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("annotated=%t: status=%d body=%s", annotated, recorder.Code, recorder.Body.String())
+		}
+
+		expectedProto := "HTTP/1.1"
+		expectedTransferEncoding := "chunked"
+		if annotated {
+			expectedProto = "HTTP/1.0"
+			expectedTransferEncoding = ""
+		}
+		if recorder.Header().Get("Echo-Proto") != expectedProto {
+			t.Errorf("annotated=%t: backend proto=%#v; expected %#v",
+				annotated, recorder.Header().Get("Echo-Proto"), expectedProto)
+		}
+		if recorder.Header().Get("Echo-Transfer-Encoding") != expectedTransferEncoding {
+			t.Errorf("annotated=%t: backend Transfer-Encoding=%#v; expected %#v",
+				annotated, recorder.Header().Get("Echo-Transfer-Encoding"), expectedTransferEncoding)
+		}
+		if recorder.Header().Get("Echo-Body") != "request body" {
+			t.Errorf("annotated=%t: backend body=%#v", annotated, recorder.Header().Get("Echo-Body"))
+		}
+		if recorder.Body.String() != "response body" {
+			t.Errorf("annotated=%t: response body=%#v", annotated, recorder.Body.String())
+		}
+	}
+}
+
+func TestProxyHTTP10TLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Echo-Proto", r.Proto)
+		w.Header().Set("Echo-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	fakeAPI := &fakeKubernetesAPIClient{}
+	fakeAPI.services.Items = append(fakeAPI.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service", Annotations: map[string]string{
+			httpVersionAnnotation: "1.0",
+		}},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "localhost",
+			Ports:     []corev1.ServicePort{{Name: "https", Protocol: corev1.ProtocolTCP, Port: int32(port)}},
+		},
+	})
+	kwp := newServer(fakeAPI)
+	kwp.http10Transport = newHTTP10Transport(newBackendTransport(0, true, 0))
+	path := fmt.Sprintf("/namespace/service/%d/", port)
+
+	// a body of known length is streamed
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader("request body"))
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Echo-Proto") != "HTTP/1.0" ||
+		recorder.Header().Get("Echo-Content-Length") != "12" {
+		t.Errorf("status=%d headers=%v; expected an HTTP/1.0 request over TLS with Content-Length 12",
+			recorder.Code, recorder.Header())
+	}
+
+	// a body of unknown length must be buffered, which is limited
+	tooLarge := strings.NewReader(strings.Repeat("x", http10MaxBufferedBody+1))
+	r = httptest.NewRequest(http.MethodPost, path, io.MultiReader(tooLarge))
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status=%d; expected %d for a large body of unknown length",
+			recorder.Code, http.StatusRequestEntityTooLarge)
+	}
+}
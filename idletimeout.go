@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Closes hijacked connections (e.g. websockets) when no bytes are read or written for timeout,
+// so abandoned connections to dead peers do not keep their copy goroutines running forever.
+type idleTimeoutWriter struct {
+	http.ResponseWriter
+	timeout time.Duration
+}
+
+func (w *idleTimeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = conn.SetDeadline(time.Now().Add(w.timeout))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return &idleTimeoutConn{conn, w.timeout}, rw, nil
+}
+
+// Unwrap allows http.ResponseController to flush the underlying ResponseWriter.
+func (w *idleTimeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// A connection that extends its deadline on every read or write. The deadline applies to both
+// directions, so a read blocked waiting for the client is extended while the backend is sending.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
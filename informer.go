@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Reads services from a local cache maintained by watching the Kubernetes API, instead of
+// making an API request for each call. Namespaces are not cached, so listNamespaces uses the
+// embedded serviceInfo.
+type informerServiceInfo struct {
+	serviceInfo
+	lister corelisters.ServiceLister
+}
+
+// Starts watching services in opts.namespace matching opts.fieldSelector, and waits until the
+// cache is loaded. These are applied when watching, so they cannot be widened by list.
+func newInformerServiceInfo(
+	clientset kubernetes.Interface, fallback serviceInfo, opts listOptions, stop <-chan struct{},
+) (*informerServiceInfo, error) {
+	informer := coreinformers.NewFilteredServiceInformer(clientset, opts.namespace, 0,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		func(options *metav1.ListOptions) {
+			options.FieldSelector = opts.fieldSelector
+		})
+	go informer.Run(stop)
+
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		return nil, fmt.Errorf("stopped before the service cache was loaded")
+	}
+	return &informerServiceInfo{fallback, corelisters.NewServiceLister(informer.GetIndexer())}, nil
+}
+
+func (i *informerServiceInfo) list(ctx context.Context, opts listOptions) (*corev1.ServiceList, error) {
+	selector := labels.Everything()
+	if opts.labelSelector != "" {
+		var err error
+		selector, err = labels.Parse(opts.labelSelector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var services []*corev1.Service
+	var err error
+	if opts.namespace == "" {
+		services, err = i.lister.List(selector)
+	} else {
+		services, err = i.lister.Services(opts.namespace).List(selector)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the cache is not ordered: sort so continue tokens can be offsets
+	sort.Slice(services, func(j, k int) bool {
+		if services[j].Namespace != services[k].Namespace {
+			return services[j].Namespace < services[k].Namespace
+		}
+		return services[j].Name < services[k].Name
+	})
+	offset := 0
+	if opts.continueToken != "" {
+		offset, err = strconv.Atoi(opts.continueToken)
+		if err != nil || offset < 0 || offset > len(services) {
+			return nil, errors.NewBadRequest(fmt.Sprintf("invalid continue token %#v", opts.continueToken))
+		}
+	}
+	services = services[offset:]
+	out := &corev1.ServiceList{}
+	if opts.limit > 0 && int64(len(services)) > opts.limit {
+		services = services[:opts.limit]
+		out.Continue = strconv.Itoa(offset + len(services))
+	}
+
+	// objects in the cache are shared and must not be modified: return copies
+	out.Items = make([]corev1.Service, len(services))
+	for j, service := range services {
+		service.DeepCopyInto(&out.Items[j])
+	}
+	return out, nil
+}
+
+func (i *informerServiceInfo) get(ctx context.Context, namespace string, name string) (*corev1.Service, error) {
+	service, err := i.lister.Services(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return service.DeepCopy(), nil
+}
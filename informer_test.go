@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestInformerServiceInfo(t *testing.T, services ...*corev1.Service) *informerServiceInfo {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, service := range services {
+		err := indexer.Add(service)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the fallback API must only be used for namespaces
+	return &informerServiceInfo{&fakeKubernetesAPIClient{}, corelisters.NewServiceLister(indexer)}
+}
+
+func TestInformerServiceInfo(t *testing.T) {
+	var services []*corev1.Service
+	for _, ns := range [][2]string{{"a", "web"}, {"a", "db"}, {"b", "web"}} {
+		services = append(services, &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns[0], Name: ns[1],
+				Labels: map[string]string{"app": ns[1]}},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}}},
+		})
+	}
+	informer := newTestInformerServiceInfo(t, services...)
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		opts          listOptions
+		expectedCount int
+	}{
+		{listOptions{}, 3},
+		{listOptions{namespace: "a"}, 2},
+		{listOptions{labelSelector: "app=web"}, 2},
+		{listOptions{namespace: "b", labelSelector: "app=db"}, 0},
+		{listOptions{limit: 1}, 1},
+	} {
+		list, err := informer.list(ctx, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Items) != test.expectedCount {
+			t.Errorf("list(%+v) returned %d services; expected %d", test.opts, len(list.Items), test.expectedCount)
+		}
+	}
+	// the cache is sorted so continue tokens return the following services
+	first, err := informer.list(ctx, listOptions{limit: 2})
+	if err != nil || first.Continue == "" || first.Items[1].Namespace+"/"+first.Items[1].Name != "a/web" {
+		t.Fatalf("first page=%v, %v", first, err)
+	}
+	next, err := informer.list(ctx, listOptions{limit: 2, continueToken: first.Continue})
+	if err != nil || len(next.Items) != 1 || next.Continue != "" || next.Items[0].Namespace != "b" {
+		t.Errorf("next page=%v, %v; expected only b/web", next, err)
+	}
+	_, err = informer.list(ctx, listOptions{labelSelector: "!!invalid"})
+	if err == nil {
+		t.Error("list with an invalid label selector should fail")
+	}
+
+	service, err := informer.get(ctx, "a", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// modifying the result must not change the cache
+	service.Labels["app"] = "modified"
+	service, err = informer.get(ctx, "a", "db")
+	if err != nil || service.Labels["app"] != "db" {
+		t.Errorf("get returned %v, %v; the cache must not be modified", service, err)
+	}
+	_, err = informer.get(ctx, "a", "missing")
+	if !errors.IsNotFound(err) {
+		t.Errorf("get of a missing service must return NotFound; got %v", err)
+	}
+
+	// the root page reads from the cache
+	s := newServer(informer)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	for _, link := range []string{`href="/a/web/80/"`, `href="/a/db/80/"`, `href="/b/web/80/"`} {
+		if !strings.Contains(recorder.Body.String(), link) {
+			t.Errorf("root page should contain %s:\n%s", link, recorder.Body.String())
+		}
+	}
+}
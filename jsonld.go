@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const jsonLDMediaType = "application/ld+json"
+
+// Returns true if t is a <script type="application/ld+json"> start tag.
+func isJSONLDScript(t *html.Token) bool {
+	if t.Type != html.StartTagToken || t.DataAtom != atom.Script {
+		return false
+	}
+	for _, attr := range t.Attr {
+		if attr.Key == "type" {
+			return strings.EqualFold(strings.TrimSpace(attr.Val), jsonLDMediaType)
+		}
+	}
+	return false
+}
+
+// Rewrites absolute-path string values in a JSON-LD document so they are based on rootPath.
+// Returns the document unchanged if it is not valid JSON or contains no paths to rewrite.
+func rewriteJSONLD(document string, rootPath string) string {
+	decoder := json.NewDecoder(strings.NewReader(document))
+	// keep numbers exactly as they were
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return document
+	}
+	value, modified := rewriteJSONValue(value, rootPath, nil)
+	if !modified {
+		return document
+	}
+
+	// Encode escapes <, > and & so the output cannot close the <script> element
+	out := &bytes.Buffer{}
+	if err := json.NewEncoder(out).Encode(value); err != nil {
+		return document
+	}
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// Rewrites absolute-path strings in value. If keys is not nil, only rewrites values of object
+// members with these keys, including strings nested inside them.
+func rewriteJSONValue(value interface{}, rootPath string, keys map[string]bool) (interface{}, bool) {
+	modified := false
+	switch v := value.(type) {
+	case string:
+		if keys == nil && strings.HasPrefix(v, "/") {
+			rewritten := rewriteURL(v, rootPath)
+			return rewritten, rewritten != v
+		}
+	case []interface{}:
+		for i, element := range v {
+			var elementModified bool
+			v[i], elementModified = rewriteJSONValue(element, rootPath, keys)
+			modified = modified || elementModified
+		}
+	case map[string]interface{}:
+		for key, element := range v {
+			elementKeys := keys
+			if keys[key] {
+				elementKeys = nil
+			}
+			var elementModified bool
+			v[key], elementModified = rewriteJSONValue(element, rootPath, elementKeys)
+			modified = modified || elementModified
+		}
+	}
+	return value, modified
+}
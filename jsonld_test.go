@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRewriteJSONLD(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{`{"@type":"WebSite","url":"/home","price":1.50}`,
+			`{"@type":"WebSite","price":1.50,"url":"/root/home"}`},
+		{`[{"image":["/a.png","https://example.com/b.png"]}]`,
+			`[{"image":["/root/a.png","https://example.com/b.png"]}]`},
+		// escaped so the output cannot close the <script> element
+		{`{"url":"/search?q=<b>&x=1"}`, `{"url":"/root/search?q=\u003cb\u003e\u0026x=1"}`},
+		// unchanged documents keep their formatting
+		{`{ "url": "https://example.com/" }`, `{ "url": "https://example.com/" }`},
+		{`{"url": "/home"`, `{"url": "/home"`},
+		{`not json /home`, `not json /home`},
+		{`{"url":"/a"} {"url":"/b"}`, `{"url":"/a"} {"url":"/b"}`},
+	}
+	for i, test := range testCases {
+		output := rewriteJSONLD(test.input, "/root")
+		if output != test.expected {
+			t.Errorf("%d: rewriteJSONLD(%#v)=%#v; expected %#v", i, test.input, output, test.expected)
+		}
+	}
+}
+
+func TestRewriteHTMLJSONLD(t *testing.T) {
+	const input = `<script type="application/ld+json">{"@context":"https://schema.org","url":"/about"}</script>` +
+		`<script type="text/javascript">var url = {"url":"/about"};</script>` +
+		`<script type="Application/LD+JSON">not json</script>`
+	const expected = `<script type="application/ld+json">{"@context":"https://schema.org","url":"/root/about"}</script>` +
+		`<script type="text/javascript">var url = {"url":"/about"};</script>` +
+		`<script type="Application/LD+JSON">not json</script>`
+	out := &bytes.Buffer{}
+	err := rewriteAbsolutePathLinks(out, strings.NewReader(input), "/root", rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("rewritten HTML=\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Service annotation enabling rewriting of absolute paths in JSON responses, for single-page apps
+// that fetch JSON containing links. "true" rewrites every string starting with "/"; otherwise it
+// lists comma-separated object keys (e.g. next,href) whose values are rewritten.
+const rewriteJSONAnnotation = "kubewebproxy.evanj/rewrite-json"
+
+// Returns true if JSON responses should be rewritten, and the keys to rewrite, or nil for all
+// strings that look like absolute paths.
+func rewriteJSONKeys(annotations map[string]string) (bool, map[string]bool) {
+	value := strings.TrimSpace(annotations[rewriteJSONAnnotation])
+	if value == "" || value == "false" {
+		return false, nil
+	}
+	if value == "true" {
+		return true, nil
+	}
+	keys := map[string]bool{}
+	for _, key := range splitList(value) {
+		keys[key] = true
+	}
+	return true, keys
+}
+
+// Returns true if contentType is JSON, including types like application/problem+json.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// Rewrites the absolute paths in the JSON document in resp. Documents that cannot be parsed, or
+// that contain nothing to rewrite, are passed through unchanged.
+func rewriteJSONResponse(resp *http.Response, rootPath string, keys map[string]bool) error {
+	original, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	setRewrittenBody(resp, rewriteJSONDocument(original, rootPath, keys))
+	return nil
+}
+
+func rewriteJSONDocument(document []byte, rootPath string, keys map[string]bool) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	// keep numbers exactly as they were
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return document
+	}
+	value, modified := rewriteJSONValue(value, rootPath, keys)
+	if !modified {
+		return document
+	}
+
+	out := &bytes.Buffer{}
+	encoder := json.NewEncoder(out)
+	// this is not embedded in HTML: keep <, > and & as they were
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return document
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
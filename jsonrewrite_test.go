@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewriteJSONDocument(t *testing.T) {
+	tests := []struct {
+		input    string
+		keys     map[string]bool
+		expected string
+	}{
+		{`{"next":"/api/page2","n":1.50}`, nil, `{"n":1.50,"next":"/root/api/page2"}`},
+		// nested objects and arrays
+		{`{"data":{"links":[{"href":"/a?x=1&y=2"},"/b","text"]},"total":12345678901234567890}`, nil,
+			`{"data":{"links":[{"href":"/root/a?x=1&y=2"},"/root/b","text"]},"total":12345678901234567890}`},
+		{`["/a",["/b"]]`, nil, `["/root/a",["/root/b"]]`},
+		// only the listed keys, including values nested inside them
+		{`{"next":"/p2","path":"/not/a/link","links":{"self":"/x"},"items":[{"next":"/p3"}]}`,
+			map[string]bool{"next": true, "links": true},
+			`{"items":[{"next":"/root/p3"}],"links":{"self":"/root/x"},"next":"/root/p2","path":"/not/a/link"}`},
+		// unchanged: returned exactly as it was
+		{`{ "a": "relative", "b": "https://example.com/" }`, nil, `{ "a": "relative", "b": "https://example.com/" }`},
+		{`{"a": "/x"`, nil, `{"a": "/x"`},
+		{`{"a": "/x"} {"b": "/y"}`, nil, `{"a": "/x"} {"b": "/y"}`},
+	}
+	for _, test := range tests {
+		output := string(rewriteJSONDocument([]byte(test.input), "/root", test.keys))
+		if output != test.expected {
+			t.Errorf("rewriteJSONDocument(%#v, %v)=%#v; expected %#v", test.input, test.keys, output, test.expected)
+		}
+	}
+}
+
+func TestRewriteJSONKeys(t *testing.T) {
+	for annotation, expected := range map[string]bool{"": false, "false": false, "true": true, "next,href": true} {
+		enabled, keys := rewriteJSONKeys(map[string]string{rewriteJSONAnnotation: annotation})
+		if enabled != expected {
+			t.Errorf("%#v: enabled=%t; expected %t", annotation, enabled, expected)
+		}
+		if annotation == "next,href" && (len(keys) != 2 || !keys["next"] || !keys["href"]) {
+			t.Errorf("%#v: keys=%v", annotation, keys)
+		}
+	}
+}
+
+func TestProxyRewriteJSON(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"next":"/api/page2"}`))
+	}))
+	kwp := newServer(fakeAPI)
+
+	for _, annotation := range []string{"", "true"} {
+		fakeAPI.services.Items[0].Annotations = map[string]string{"kubewebproxy.evanj/rewrite-json": annotation}
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/api/page1", port), nil)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		expected := `{"next":"/api/page2"}`
+		if annotation == "true" {
+			expected = fmt.Sprintf(`{"next":"/namespace/service/%d/api/page2"}`, port)
+		}
+		if recorder.Body.String() != expected {
+			t.Errorf("annotation=%#v: body=%#v; expected %#v", annotation, recorder.Body.String(), expected)
+		}
+		if recorder.Header().Get("Content-Length") != fmt.Sprint(len(expected)) {
+			t.Errorf("annotation=%#v: Content-Length=%#v", annotation, recorder.Header().Get("Content-Length"))
+		}
+	}
+}
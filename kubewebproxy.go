@@ -3,21 +3,28 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
 	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"regexp"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	texttemplate "text/template"
+	"time"
 
 	"github.com/evanj/googlesignin/iap"
 	"golang.org/x/net/html"
@@ -25,6 +32,8 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -32,60 +41,303 @@ import (
 const portEnvVar = "PORT"
 const defaultPort = "8080"
 const htmlMediaType = "text/html"
+const xhtmlMediaType = "application/xhtml+xml"
+const cssMediaType = "text/css"
 const googleHealthCheckUserAgent = "googlehc/"
 const kubernetesHealthCheckUserAgent = "kube-probe/"
+const defaultHealthPath = "/health"
+
+// Readiness check path: unlike the health check, it fails if the Kubernetes API cannot be reached.
+const readyPath = "/ready"
+const readyTimeout = 3 * time.Second
+
+// Request header containing the externally visible URL, for backends that generate absolute links.
+const originalURLHeader = "X-Kubewebproxy-Original-URL"
+
+// Service annotation overriding -backendTimeout, as a Go duration (e.g. 60s).
+const timeoutAnnotation = "kubewebproxy.evanj/timeout"
+
+// Service annotation that replaces the Content-Type of responses, for backends that serve HTML
+// with the wrong type (e.g. text/plain), which means it is not rewritten.
+const forceContentTypeAnnotation = "kubewebproxy.evanj/forceContentType"
+
+// Service annotation that must be "true" for a service to be listed and proxied, if
+// -requireAnnotation is set.
+const exposeAnnotation = "kubewebproxy.evanj/expose"
 
 var servicePattern = regexp.MustCompile(`^/([^/]+)/([^/]+)/([^/]+)(.*)$`)
 
+// Addresses a service by its metadata UID instead of namespace/name: /_uid/(uid)/(port)(path).
+// This must be checked before servicePattern, which also matches these paths. Namespace names
+// cannot contain "_", so this does not hide a namespace.
+var uidPattern = regexp.MustCompile(`^/_uid/([^/]+)/([^/]+)(.*)$`)
+
+var consecutiveSlashes = regexp.MustCompile(`//+`)
+
+// Options for listing services. The zero value lists all services.
+type listOptions struct {
+	// if set, only list services in this namespace
+	namespace       string
+	limit           int64
+	fieldSelector   string
+	labelSelector   string
+	resourceVersion string
+	// continue token from a previous list with a limit, to return the next page
+	continueToken string
+}
+
 type serviceInfo interface {
-	list(ctx context.Context, limit int64) (*corev1.ServiceList, error)
+	list(ctx context.Context, opts listOptions) (*corev1.ServiceList, error)
 	get(ctx context.Context, namespace string, name string) (*corev1.Service, error)
+	listNamespaces(ctx context.Context) ([]string, error)
 }
 
 type kubernetesAPIClient struct {
 	clientset *kubernetes.Clientset
 }
 
-func (k *kubernetesAPIClient) list(ctx context.Context, limit int64) (*corev1.ServiceList, error) {
-	return k.clientset.CoreV1().Services("").List(ctx, metav1.ListOptions{Limit: limit})
+func (k *kubernetesAPIClient) list(ctx context.Context, opts listOptions) (*corev1.ServiceList, error) {
+	return k.clientset.CoreV1().Services(opts.namespace).List(ctx, metav1.ListOptions{
+		Limit:           opts.limit,
+		FieldSelector:   opts.fieldSelector,
+		LabelSelector:   opts.labelSelector,
+		ResourceVersion: opts.resourceVersion,
+		Continue:        opts.continueToken,
+	})
 }
 func (k *kubernetesAPIClient) get(ctx context.Context, namespace string, name string) (*corev1.Service, error) {
 	return k.clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
 }
+func (k *kubernetesAPIClient) listNamespaces(ctx context.Context) ([]string, error) {
+	namespaces, err := k.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, ns := range namespaces.Items {
+		names = append(names, ns.Name)
+	}
+	return names, nil
+}
 
 type origRequestData struct {
 	namespace string
 	service   string
 	port      int64
 	destPath  string
+	// path prefix the service is proxied under; absolute paths are rewritten relative to it
+	rootPath string
+	// timeout for the entire proxied request, or zero for no timeout; see resolveTimeout
+	timeout time.Duration
+	// the service's annotations
+	annotations  map[string]string
+	metricLabels proxyMetricLabels
 }
 
 type origRequestDataContextKey struct{}
 
+// An error that should be returned to the client with a specific HTTP status code.
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
 type server struct {
-	services     serviceInfo
-	reverseProxy *httputil.ReverseProxy
+	services serviceInfo
+	// used to proxy directly to pods; nil disables /_pods/ paths
+	pods podInfo
+	// used to connect to headless services; nil connects to the ClusterIP of all services
+	endpoints endpointInfo
+	// if true, connect to a ready endpoint of every service instead of its ClusterIP
+	directEndpoints bool
+	reverseProxy    *httputil.ReverseProxy
+	// used instead of reverseProxy.Transport for services with httpVersionAnnotation
+	http10Transport *http10Transport
+	// options used when listing services, e.g. to restrict them with a field selector
+	listOptions listOptions
+	// options for rewriting links in proxied HTML
+	rewriteOptions rewriteOptions
+	// default timeout for proxied requests; zero means no timeout
+	backendTimeout time.Duration
+	// if true, /robots.txt permits crawlers to index the proxy
+	allowIndexing bool
+	// if true, proxying returns 503 Service Unavailable; toggled by /admin/maintenance
+	maintenance atomic.Bool
+	// emails of IAP users allowed to use /admin/maintenance
+	maintenanceAdmins map[string]bool
+	// returns the email of the user that sent a request; iapEmail except in tests
+	userEmail func(r *http.Request) string
+	// if not nil, only these request headers (canonical form) are forwarded to backends, in
+	// addition to essentialRequestHeaders
+	forwardHeaders map[string]bool
+	// path of the health check endpoint, which is not protected by IAP
+	healthPath string
+	// if set, requests to / with this header are also health checks
+	healthCheckHeader healthCheckHeader
+	// counts proxied requests for /metrics
+	metrics *proxyMetrics
+	// writes logs as text or JSON; see -logFormat
+	logger *logger
+	// if set, the SameSite attribute for all cookies set by backends
+	cookieSameSite string
+	// Link header values (e.g. "</>; rel=prefetch") added to HTML responses, with their URIs
+	// rewritten relative to the service
+	linkHints []string
+	// order of the service list: one of the sortBy* constants
+	sortBy string
+	// if set, group the service list by the value of this label instead of by namespace
+	groupByLabel string
+	// proxied requests taking longer than this are logged as warnings; zero disables
+	slowRequestThreshold time.Duration
+	// if true, append kubewebproxy/(version) to the User-Agent sent to backends
+	appendUserAgent bool
+	// values of these query parameters are replaced with redactedValue in logs
+	redactQueryParams map[string]bool
+	// if not nil, only HTML responses with these status codes are rewritten
+	rewriteStatusCodes map[int]bool
+	// if not nil, builds the backend host:port from backendAddrTemplateData
+	backendAddrTemplate *texttemplate.Template
+	// banner HTML by namespace, with defaultBannerKey for other namespaces
+	banners map[string]string
+	// connections hijacked by proxied protocol upgrades, which are closed on shutdown
+	hijacked *hijackedConns
+	// services in these namespaces are not listed, but can still be proxied
+	hiddenNamespaces map[string]bool
+	// Forwarded and X-Forwarded-* request headers are only kept from these addresses
+	trustedProxies []*net.IPNet
+	// if true, the service list links to named ports by name instead of number
+	linkPortNames bool
+	// if true, requests without an X-Cloud-Trace-Context header are given a new trace ID
+	generateTraceIDs bool
+	// if true, only services with the exposeAnnotation are listed and proxied
+	requireAnnotation bool
+	// services that are never listed or proxied; see authorize for the precedence of these rules
+	denyServices serviceSet
+	// services that are always listed and proxied, unless denied by denyServices
+	allowServices serviceSet
+	// if not nil, only services in these namespaces are listed and proxied
+	allowNamespaces map[string]bool
+	// if not nil, only services with labels matching it are listed and proxied
+	serviceSelector labels.Selector
+	// maximum number of concurrent proxied protocol upgrades (e.g. websockets); zero is unlimited
+	maxWebsockets int
+	// number of proxied protocol upgrades in progress, including open upgraded connections
+	activeWebsockets atomic.Int64
+	// if > 0, upgraded connections with no bytes in either direction for this long are closed
+	websocketIdleTimeout time.Duration
+	// if true, proxied HTML responses are sent with Cache-Control: no-store, private
+	noCacheProxiedContent bool
+	// reads secrets for injectHeaderSecretAnnotation; nil if -injectHeaderSecrets is not set
+	secrets secretInfo
+	// limits requests per client; nil if -rateLimit is not set
+	rateLimiter *clientRateLimiter
+	// if set, the path prefix the proxy is served under (e.g. /kwp), without a trailing slash
+	basePath string
+}
+
+// Returns the version of this binary from the Go build information.
+func proxyVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "dev"
+	}
+	return info.Main.Version
+}
+
+// Returns the User-Agent to send to backends for a client's User-Agent.
+func proxyUserAgent(clientUserAgent string) string {
+	proxyAgent := "kubewebproxy/" + proxyVersion()
+	if clientUserAgent == "" {
+		return proxyAgent
+	}
+	return clientUserAgent + " " + proxyAgent
+}
+
+// Request headers that are always forwarded since requests will not work without them.
+// ReverseProxy needs Connection to remove the hop-by-hop headers it lists, and Connection and
+// Upgrade to forward protocol upgrades (RFC 7230 section 6.1).
+var essentialRequestHeaders = map[string]bool{
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Upgrade":           true,
+}
+
+// Splits a comma-separated flag value into a list, ignoring whitespace and empty items.
+func splitList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Replaces the values of redacted query parameters in logs.
+const redactedValue = "REDACTED"
+
+// Returns u as a string for logging, with the values of query parameters in redactParams
+// replaced by redactedValue. The order of the parameters is preserved.
+func redactURL(u *url.URL, redactParams map[string]bool) string {
+	if len(redactParams) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if redactParams[name] {
+			params[i] = key + "=" + redactedValue
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = strings.Join(params, "&")
+	return redacted.String()
 }
 
 func newServer(services serviceInfo) *server {
-	s := &server{services: services}
+	s := &server{
+		services:        newCoalescingServiceInfo(services),
+		healthPath:      defaultHealthPath,
+		sortBy:          sortByNamespaceName,
+		hijacked:        newHijackedConns(),
+		logger:          newTextLogger(),
+		metrics:         newProxyMetrics(),
+		trustedProxies:  defaultTrustedProxies,
+		http10Transport: newHTTP10Transport(nil),
+		userEmail:       iapEmail,
+	}
 	s.reverseProxy = &httputil.ReverseProxy{
 		// Director does nothing: we rewrite in proxy
 		Director:       func(*http.Request) {},
 		ModifyResponse: s.proxyRewriter,
+		ErrorHandler:   s.proxyErrorHandler,
 	}
 	return s
 }
 
 func (s *server) checkPermissions(ctx context.Context) error {
 	// attempt to list a single service to see if we have permission
-	_, err := s.services.list(ctx, 1)
+	opts := s.listOptions
+	opts.limit = 1
+	_, err := s.services.list(ctx, opts)
 	return err
 }
 
 func (s *server) healthHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("health check %s URL=%s RemoteAddr=%s UserAgent=%s",
-		r.Method, r.URL.String(), r.RemoteAddr, r.UserAgent())
+	s.logger.info("health check", logFields{"method": r.Method, "url": redactURL(r.URL, s.redactQueryParams),
+		"remote_addr": r.RemoteAddr, "user_agent": r.UserAgent()})
 	if r.Method != http.MethodGet {
 		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
 		return
@@ -95,6 +347,45 @@ func (s *server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok\n"))
 }
 
+// Returns 503 if listing services fails, so Kubernetes stops sending requests to a proxy that
+// cannot reach the API server. The health check stays cheap, so this does not restart the pod.
+func (s *server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	err := s.checkPermissions(ctx)
+	if err != nil {
+		s.logger.warning("not ready: listing services failed", logFields{"error": err.Error()})
+		http.Error(w, "not ready: listing services failed", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+const robotsDisallowAll = "User-agent: *\nDisallow: /\n"
+const robotsAllowAll = "User-agent: *\nDisallow:\n"
+
+// Serves robots.txt. This is not protected by IAP so crawlers can read it, and by default asks
+// them not to index anything, since proxied services are internal.
+func (s *server) robotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	if s.allowIndexing {
+		w.Write([]byte(robotsAllowAll))
+	} else {
+		w.Write([]byte(robotsDisallowAll))
+	}
+}
+
 var healthCheckUserAgents = []string{
 	googleHealthCheckUserAgent, kubernetesHealthCheckUserAgent,
 }
@@ -116,6 +407,39 @@ func isRootHealthCheck(r *http.Request) bool {
 	return false
 }
 
+// A header that marks requests to / as health checks, for load balancers that probe without a
+// recognizable User-Agent. An empty value matches any value.
+type healthCheckHeader struct {
+	name  string
+	value string
+}
+
+// Parses a -healthCheckHeader of the form "Name" or "Name: value".
+func parseHealthCheckHeader(flagValue string) (healthCheckHeader, error) {
+	if flagValue == "" {
+		return healthCheckHeader{}, nil
+	}
+	name, value, _ := strings.Cut(flagValue, ":")
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return healthCheckHeader{}, fmt.Errorf("invalid header name %#v", name)
+	}
+	return healthCheckHeader{http.CanonicalHeaderKey(name), strings.TrimSpace(value)}, nil
+}
+
+// Returns true if this is a request to / with the -healthCheckHeader.
+func (h healthCheckHeader) matches(r *http.Request) bool {
+	if h.name == "" || r.URL.Path != "/" {
+		return false
+	}
+	for _, value := range r.Header.Values(h.name) {
+		if h.value == "" || strings.EqualFold(strings.TrimSpace(value), h.value) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) {
 	if servicePattern.MatchString(r.URL.Path) {
 		s.proxyErrWrapper(w, r)
@@ -125,57 +449,87 @@ func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO: Add back email/user log once we add the test library to iap
 	// email := iap.Email(r)
 	// log.Printf("rootHandler user=%s %s %s", email, r.Method, r.URL.String())
-	log.Printf("rootHandler %s %s", r.Method, r.URL.String())
-	if r.Method != http.MethodGet {
+	s.logger.info("rootHandler", logFields{"method": r.Method,
+		"url": redactURL(r.URL, s.redactQueryParams)})
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
 		return
 	}
 	if r.URL.Path != "/" {
-		http.Error(w, "not found", http.StatusNotFound)
+		s.writeError(w, r, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodHead {
+		// used by monitoring to check availability: skip listing services, which is expensive
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		return
 	}
 
 	ctx := r.Context()
 
-	// get services in all the namespaces by omitting namespace
-	// Or specify namespace to get pods in particular namespace
-	services, err := s.services.list(ctx, 0)
+	services, skippedNamespaces, err := s.listDisplayedServices(ctx)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.logger.warning("listing services failed", logFields{"error": err.Error()})
+		s.writeError(w, r, internalErrorMessage, http.StatusInternalServerError)
 		return
 	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query != "" {
+		services.Items = filterServices(services.Items, query)
+	}
 
-	// sort on the (namespace, name) pair
-	sort.Slice(services.Items, func(i, j int) bool {
-		if services.Items[i].Namespace != services.Items[j].Namespace {
-			return services.Items[i].Namespace < services.Items[j].Namespace
-		}
-		return services.Items[i].Name < services.Items[j].Name
-	})
+	if s.groupByLabel != "" {
+		// keep the order within each group; unlabeled services go last
+		sort.SliceStable(services.Items, func(i, j int) bool {
+			iValue, iOK := services.Items[i].Labels[s.groupByLabel]
+			jValue, jOK := services.Items[j].Labels[s.groupByLabel]
+			if iOK != jOK {
+				return iOK
+			}
+			return iValue < jValue
+		})
+	}
 
-	data := &rootTemplateData{}
-	lastNamespace := ""
-	for _, s := range services.Items {
-		if s.Namespace != lastNamespace {
-			data.Namespaces = append(data.Namespaces, namespaceTemplateData{
-				Name: s.Namespace,
+	data := &rootTemplateData{
+		BasePath:          s.basePath,
+		Query:             query,
+		Maintenance:       s.maintenance.Load(),
+		SkippedNamespaces: skippedNamespaces,
+	}
+	lastGroupKey := ""
+	for i, service := range services.Items {
+		heading, groupKey, showNamespace := s.serviceGroup(&service)
+		if i == 0 || groupKey != lastGroupKey {
+			data.Groups = append(data.Groups, groupTemplateData{
+				Heading:       heading,
+				ShowNamespace: showNamespace,
 			})
-			lastNamespace = s.Namespace
+			lastGroupKey = groupKey
 		}
-
-		lastNSData := &data.Namespaces[len(data.Namespaces)-1]
+		group := &data.Groups[len(data.Groups)-1]
 
 		tcpPorts := []portTemplateData{}
-		for _, p := range s.Spec.Ports {
+		for _, p := range service.Spec.Ports {
 			if p.Protocol == corev1.ProtocolTCP {
-				tcpPorts = append(tcpPorts, portTemplateData{p.Name, int(p.Port)})
+				link := strconv.Itoa(int(p.Port))
+				if s.linkPortNames && p.Name != "" {
+					link = p.Name
+				}
+				tcpPorts = append(tcpPorts, portTemplateData{p.Name, int(p.Port), link})
 			}
 		}
-		lastNSData.Services = append(lastNSData.Services, serviceTemplateData{
-			Name:      s.Name,
-			ClusterIP: s.Spec.ClusterIP,
+		serviceData := serviceTemplateData{
+			Namespace: service.Namespace,
+			Name:      service.Name,
+			ClusterIP: service.Spec.ClusterIP,
+			Type:      string(service.Spec.Type),
+			Labels:    service.Labels,
 			TCPPorts:  tcpPorts,
-		})
+		}
+		if sunset, ok := s.serviceSunset(service.Namespace, service.Name, service.Annotations); ok {
+			serviceData.Sunset = sunset.Format("2006-01-02")
+		}
+		group.Services = append(group.Services, serviceData)
 	}
 
 	err = rootTemplate.Execute(w, data)
@@ -185,38 +539,301 @@ func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// proxies a request
-func (s *server) proxyErrWrapper(w http.ResponseWriter, r *http.Request) {
-	log.Printf("proxy %s %s", r.Method, r.URL.String())
-	err := s.proxy(w, r)
+// Returns the services where namespace/name contains query, ignoring case. Filters in place.
+func filterServices(services []corev1.Service, query string) []corev1.Service {
+	lowerQuery := strings.ToLower(query)
+	filtered := services[:0]
+	for _, service := range services {
+		if strings.Contains(strings.ToLower(service.Namespace+"/"+service.Name), lowerQuery) {
+			filtered = append(filtered, service)
+		}
+	}
+	return filtered
+}
+
+// heading of the group of services without the -groupByLabel label
+const unlabeledGroup = "unlabeled"
+
+// Returns the heading of the service list group that service belongs to, a key that is equal
+// for services in the same group, and true if the group contains services from multiple
+// namespaces.
+func (s *server) serviceGroup(service *corev1.Service) (string, string, bool) {
+	if s.groupByLabel != "" {
+		value, ok := service.Labels[s.groupByLabel]
+		if !ok {
+			return unlabeledGroup, "", true
+		}
+		return s.groupByLabel + ": " + value, "=" + value, true
+	}
+	if s.sortBy == sortByName {
+		return "All Namespaces", "", true
+	}
+	return "Namespace " + service.Namespace, service.Namespace, false
+}
+
+// Lists the services shown to users: authorized services not in hiddenNamespaces, sorted by
+// sortBy. Also returns the namespaces skipped by listVisibleServices.
+func (s *server) listDisplayedServices(ctx context.Context) (*corev1.ServiceList, []string, error) {
+	services, skippedNamespaces, err := s.listVisibleServices(ctx)
 	if err != nil {
-		if errors.IsNotFound(err) {
-			http.NotFound(w, r)
-		} else {
-			log.Printf("proxy error: %s", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, err
+	}
+
+	services.Items = s.filterDisplayed(services.Items)
+	sortServices(services.Items, s.sortBy)
+	return services, skippedNamespaces, nil
+}
+
+// Removes services in -hiddenNamespaces or denied by authorize, in place.
+func (s *server) filterDisplayed(services []corev1.Service) []corev1.Service {
+	visible := services[:0]
+	for _, service := range services {
+		if !s.hiddenNamespaces[service.Namespace] && s.authorize(&service).allowed {
+			visible = append(visible, service)
 		}
 	}
+	return visible
 }
 
-func (s *server) proxy(w http.ResponseWriter, r *http.Request) error {
-	matches := servicePattern.FindStringSubmatch(r.URL.Path)
-	if len(matches) != 5 {
-		return fmt.Errorf("bad path: %s", r.URL.Path)
+// Lists services in all namespaces. If we are not permitted to list services in all
+// namespaces, this lists each namespace separately, and returns the namespaces that were
+// skipped because listing them was forbidden.
+func (s *server) listVisibleServices(ctx context.Context) (*corev1.ServiceList, []string, error) {
+	services, err := s.services.list(ctx, s.listOptions)
+	if err == nil || !errors.IsForbidden(err) || s.listOptions.namespace != "" {
+		return services, nil, err
 	}
-	namespace, service, port, destPath := matches[1], matches[2], matches[3], matches[4]
-	log.Printf("ns=%s service=%s port=%s destPath=%s", namespace, service, port, destPath)
+	s.logger.warning("forbidden from listing services in all namespaces; listing each namespace",
+		logFields{"error": err.Error()})
 
-	parsedPort, err := strconv.ParseInt(port, 10, 32)
+	namespaces, err := s.services.listNamespaces(ctx)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	services = &corev1.ServiceList{}
+	var skipped []string
+	for _, namespace := range namespaces {
+		opts := s.listOptions
+		opts.namespace = namespace
+		nsServices, err := s.services.list(ctx, opts)
+		if errors.IsForbidden(err) {
+			s.logger.warning("skipping namespace", logFields{"namespace": namespace, "error": err.Error()})
+			skipped = append(skipped, namespace)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		services.Items = append(services.Items, nsServices.Items...)
+	}
+	return services, skipped, nil
+}
+
+// Values for -sortBy.
+const (
+	sortByNamespaceName = "ns-name"
+	sortByName          = "name"
+	sortByNamespace     = "namespace"
+)
+
+// Sorts services for the service list according to sortBy.
+func sortServices(services []corev1.Service, sortBy string) {
+	switch sortBy {
+	case sortByName:
+		sort.Slice(services, func(i, j int) bool {
+			if services[i].Name != services[j].Name {
+				return services[i].Name < services[j].Name
+			}
+			return services[i].Namespace < services[j].Namespace
+		})
+	case sortByNamespace:
+		// keep the order returned by the API within each namespace
+		sort.SliceStable(services, func(i, j int) bool {
+			return services[i].Namespace < services[j].Namespace
+		})
+	default:
+		// sort on the (namespace, name) pair
+		sort.Slice(services, func(i, j int) bool {
+			if services[i].Namespace != services[j].Namespace {
+				return services[i].Namespace < services[j].Namespace
+			}
+			return services[i].Name < services[j].Name
+		})
+	}
+}
+
+// Request body to enable or disable maintenance mode.
+type maintenanceRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// Reports maintenance mode on GET, and enables or disables it on POST with the JSON body
+// {"enabled": true|false}. Only IAP users in -maintenanceAdmins may use it. Requiring JSON means a
+// cross-site HTML form cannot change it. The mode is only stored in memory: with more than one
+// replica, each one must be changed separately.
+func (s *server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.info("maintenanceHandler", logFields{"method": r.Method,
+		"url": redactURL(r.URL, s.redactQueryParams)})
+	email := s.userEmail(r)
+	if !s.maintenanceAdmins[email] {
+		s.logger.warning("maintenanceHandler forbidden", logFields{"email": email})
+		http.Error(w, "forbidden: only -maintenanceAdmins may use this", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		var request maintenanceRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&request)
+		if err != nil || request.Enabled == nil {
+			http.Error(w, `body must be {"enabled": true|false}`, http.StatusBadRequest)
+			return
+		}
+		s.maintenance.Store(*request.Enabled)
+		s.logger.info("maintenance mode set", logFields{"enabled": *request.Enabled, "email": email})
+	default:
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	fmt.Fprintf(w, "maintenance=%t\n", s.maintenance.Load())
+}
+
+// proxies a request
+func (s *server) proxyErrWrapper(w http.ResponseWriter, r *http.Request) {
+	traceID := s.traceRequest(r)
+	s.logger.info("proxy", withTraceID(logFields{"method": r.Method,
+		"url": redactURL(r.URL, s.redactQueryParams)}, traceID))
+	if s.maintenance.Load() {
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		maintenanceTemplate.Execute(w, s.basePath)
+		return
 	}
+	// proxy rewrites r.URL: save the original for logging
+	origPath := r.URL.Path
+	recorder := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	var metricLabels proxyMetricLabels
+	err := s.proxy(recorder, r, &metricLabels)
+	duration := time.Since(start)
+	if s.slowRequestThreshold > 0 && duration > s.slowRequestThreshold {
+		s.logger.warning("slow request", logFields{"method": r.Method, "path": origPath,
+			"duration_ms": duration.Milliseconds(), "threshold_ms": s.slowRequestThreshold.Milliseconds()})
+	}
+	if err != nil {
+		recorder.Header().Set(proxyStatusHeader, proxyStatus(err))
+		if statusErr, ok := err.(*statusError); ok {
+			s.writeError(recorder, r, statusErr.message, statusErr.code)
+		} else if errors.IsNotFound(err) {
+			s.writeError(recorder, r, "404 page not found", http.StatusNotFound)
+		} else {
+			s.logger.warning("proxy error", logFields{"path": origPath, "error": err.Error()})
+			s.writeError(recorder, r, internalErrorMessage, http.StatusInternalServerError)
+		}
+	}
+
+	code := recorder.status
+	if code == 0 {
+		// nothing was written, which net/http sends as 200 OK, or the connection was hijacked
+		code = http.StatusOK
+	}
+	s.metrics.observe(metricLabels.namespace, metricLabels.service, code, duration)
+	s.logger.info("proxied", withTraceID(logFields{"namespace": metricLabels.namespace,
+		"service": metricLabels.service, "method": r.Method, "path": origPath, "status": code,
+		"duration_ms": duration.Milliseconds(), "remote_addr": r.RemoteAddr}, traceID))
+}
 
+// Proxies a request. Sets metricLabels once the service is found and allowed.
+func (s *server) proxy(w http.ResponseWriter, r *http.Request, metricLabels *proxyMetricLabels) error {
 	ctx := r.Context()
-	serviceMeta, err := s.services.get(ctx, namespace, service)
+	var serviceMeta *corev1.Service
+	var port, destPath, rootPath string
+	var err error
+	isPod := false
+	if matches := podPattern.FindStringSubmatch(r.URL.Path); len(matches) == 5 {
+		namespace, pod := matches[1], matches[2]
+		port, destPath = matches[3], matches[4]
+		s.logger.info("proxy pod", logFields{"namespace": namespace, "pod": pod, "port": port, "dest_path": destPath})
+		if s.pods == nil {
+			return &statusError{http.StatusNotFound, "proxying to pods is not enabled"}
+		}
+		if s.listOptions.namespace != "" && namespace != s.listOptions.namespace {
+			// the same status as a service that does not exist
+			return &statusError{http.StatusNotFound, fmt.Sprintf(
+				"namespace %s cannot be proxied: only pods in namespace %s are accessible",
+				namespace, s.listOptions.namespace)}
+		}
+		var podMeta *corev1.Pod
+		podMeta, err = s.pods.getPod(ctx, namespace, pod)
+		if err == nil {
+			serviceMeta, err = serviceForPod(podMeta)
+		}
+		rootPath = "/_pods/" + namespace + "/" + pod
+		isPod = true
+	} else if matches := uidPattern.FindStringSubmatch(r.URL.Path); len(matches) == 4 {
+		uid := matches[1]
+		port, destPath = matches[2], matches[3]
+		s.logger.info("proxy uid", logFields{"uid": uid, "port": port, "dest_path": destPath})
+		serviceMeta, err = s.getByUID(ctx, uid)
+		rootPath = "/_uid/" + uid
+	} else {
+		matches := servicePattern.FindStringSubmatch(r.URL.Path)
+		if len(matches) != 5 {
+			return fmt.Errorf("bad path: %s", r.URL.Path)
+		}
+		namespace, service := matches[1], matches[2]
+		port, destPath = matches[3], matches[4]
+		s.logger.info("proxy service", logFields{"namespace": namespace, "service": service, "port": port,
+			"dest_path": destPath})
+		if s.listOptions.namespace != "" && namespace != s.listOptions.namespace {
+			// the same status as a service that does not exist
+			return &statusError{http.StatusNotFound, fmt.Sprintf(
+				"namespace %s cannot be proxied: only services in namespace %s are accessible",
+				namespace, s.listOptions.namespace)}
+		}
+		serviceMeta, err = s.services.get(ctx, namespace, service)
+		rootPath = "/" + namespace + "/" + service
+	}
 	if err != nil {
 		return err
 	}
+	var decision accessDecision
+	if isPod {
+		decision, err = s.authorizePod(ctx, serviceMeta)
+		if err != nil {
+			return err
+		}
+	} else {
+		decision = s.authorize(serviceMeta)
+	}
+	if !decision.allowed {
+		s.logger.info("access denied", logFields{"namespace": serviceMeta.Namespace,
+			"service": serviceMeta.Name, "reason": decision.reason})
+		// the same response as a service that does not exist
+		return &statusError{http.StatusNotFound, "404 page not found"}
+	}
+	*metricLabels = serviceMetricLabels(serviceMeta, isPod)
+
+	parsedPort, err := strconv.ParseInt(port, 10, 32)
+	if err == nil {
+		rootPath = fmt.Sprintf("%s/%d", rootPath, parsedPort)
+	} else {
+		parsedPort, err = resolveNamedPort(serviceMeta, port)
+		if err != nil {
+			return err
+		}
+		rootPath = rootPath + "/" + port
+	}
+	rootPath = s.basePath + rootPath
+	// some backends reject paths containing "//"
+	destPath = consecutiveSlashes.ReplaceAllString(destPath, "/")
 
 	// make sure a matching TCP port exists
 	found := false
@@ -227,46 +844,303 @@ func (s *server) proxy(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 	if !found {
-		return fmt.Errorf("port %d not found", parsedPort)
+		var available []string
+		for _, p := range serviceMeta.Spec.Ports {
+			if p.Protocol == corev1.ProtocolTCP {
+				available = append(available, strconv.Itoa(int(p.Port)))
+			} else if p.Port == int32(parsedPort) {
+				return &statusError{http.StatusBadRequest, fmt.Sprintf(
+					"service %s/%s port %d exists only as %s and cannot be web proxied; only TCP ports can",
+					serviceMeta.Namespace, serviceMeta.Name, parsedPort, p.Protocol)}
+			}
+		}
+		if len(available) == 0 {
+			return &statusError{http.StatusBadRequest, fmt.Sprintf(
+				"service %s/%s exposes no TCP ports and cannot be web proxied",
+				serviceMeta.Namespace, serviceMeta.Name)}
+		}
+		return &statusError{http.StatusNotFound, fmt.Sprintf(
+			"service %s/%s exists but port %d was not found; it may have changed since the service list was loaded; available TCP ports: %s",
+			serviceMeta.Namespace, serviceMeta.Name, parsedPort, strings.Join(available, ", "))}
 	}
 
-	r.URL.Scheme = "http"
-	r.URL.Host = fmt.Sprintf("%s:%d", serviceMeta.Spec.ClusterIP, parsedPort)
+	if !isTrustedProxy(r.RemoteAddr, s.trustedProxies) {
+		stripForwardedHeaders(r.Header)
+	}
+	if s.forwardHeaders != nil {
+		for name := range r.Header {
+			if !s.forwardHeaders[name] && !essentialRequestHeaders[name] && name != cloudTraceHeader {
+				r.Header.Del(name)
+			}
+		}
+	}
+	r.Header.Set(originalURLHeader, originalURL(r, s.basePath))
+	// pod annotations are set by whoever can create pods, so they must not read secrets
+	if !isPod {
+		err = s.injectSecretHeader(ctx, r.Header, serviceMeta)
+		if err != nil {
+			return err
+		}
+	}
+	if s.appendUserAgent {
+		r.Header.Set("User-Agent", proxyUserAgent(r.UserAgent()))
+	}
+	// -backendAddrTemplate describes how to reach services, so pods are always connected to directly
+	backendAddr := net.JoinHostPort(serviceMeta.Spec.ClusterIP, strconv.FormatInt(parsedPort, 10))
+	if !isPod {
+		backendAddr, err = s.resolveBackendAddr(ctx, serviceMeta, parsedPort)
+		if err != nil {
+			return err
+		}
+	}
+	r.URL.Scheme = s.backendScheme(serviceMeta, parsedPort)
+	r.URL.Host = backendAddr
 	r.URL.Path = destPath
-	log.Printf("proxying to %s", r.URL.String())
+	s.logger.info("proxying", logFields{"url": redactURL(r.URL, s.redactQueryParams)})
 
 	// bit of a hack: store the original request data in the request context so the ReverseProxy
 	// response rewriter can access it
-	origData := origRequestData{namespace, service, parsedPort, destPath}
+	timeout := s.resolveTimeout(r, serviceMeta)
+	origData := origRequestData{serviceMeta.Namespace, serviceMeta.Name, parsedPort, destPath,
+		rootPath, timeout, serviceMeta.Annotations, *metricLabels}
 	rCtxWithData := context.WithValue(r.Context(), origRequestDataContextKey{}, origData)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		rCtxWithData, cancel = context.WithTimeout(rCtxWithData, timeout)
+		defer cancel()
+	}
+	// WithContext shares r.Body, so request bodies are streamed to the backend without buffering
 	r2 := r.WithContext(rCtxWithData)
 
-	s.reverseProxy.ServeHTTP(w, r2)
+	reverseProxy := s.reverseProxy
+	if version, ok := serviceMeta.Annotations[httpVersionAnnotation]; ok {
+		if version == "1.0" {
+			http10Proxy := *s.reverseProxy
+			http10Proxy.Transport = s.http10Transport
+			reverseProxy = &http10Proxy
+		} else {
+			s.logger.warning("ignoring invalid annotation", logFields{"namespace": serviceMeta.Namespace,
+				"service": serviceMeta.Name, "annotation": httpVersionAnnotation, "value": version})
+		}
+	}
+	// ReverseProxy handles protocol upgrades (e.g. websockets) by hijacking the connection and
+	// copying bytes in both directions, after the checks above
+	if r.Header.Get("Upgrade") != "" {
+		// ServeHTTP returns after the upgraded connection is closed, so this counts open connections
+		if s.maxWebsockets > 0 {
+			defer s.activeWebsockets.Add(-1)
+			if s.activeWebsockets.Add(1) > int64(s.maxWebsockets) {
+				return &statusError{http.StatusServiceUnavailable, fmt.Sprintf(
+					"too many websocket connections: the limit is %d", s.maxWebsockets)}
+			}
+		}
+		w = s.hijacked.track(w)
+		if s.websocketIdleTimeout > 0 {
+			w = &idleTimeoutWriter{w, s.websocketIdleTimeout}
+		}
+	}
+	reverseProxy.ServeHTTP(w, r2)
 	return nil
 }
 
+// Returns the number of the TCP port of service named name.
+func resolveNamedPort(service *corev1.Service, name string) (int64, error) {
+	var available []string
+	for _, p := range service.Spec.Ports {
+		if p.Protocol != corev1.ProtocolTCP || p.Name == "" {
+			continue
+		}
+		if p.Name == name {
+			return int64(p.Port), nil
+		}
+		available = append(available, p.Name)
+	}
+	return 0, &statusError{http.StatusNotFound, fmt.Sprintf(
+		"service %s/%s has no TCP port named %s; available named TCP ports: %s",
+		service.Namespace, service.Name, name, strings.Join(available, ", "))}
+}
+
+// Returns the externally visible URL for r, which must not have been rewritten yet.
+func originalURL(r *http.Request, basePath string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" || proto == "http" {
+		// TLS terminated by a load balancer e.g. Google Cloud's HTTPS load balancer
+		scheme = proto
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: basePath + r.URL.Path, RawQuery: r.URL.RawQuery}
+	if r.URL.RawPath != "" {
+		u.RawPath = basePath + r.URL.RawPath
+	}
+	return u.String()
+}
+
+// Returns the timeout for proxying r to service, or zero for no timeout. In order of precedence:
+//
+//  1. Streaming requests (server-sent events and protocol upgrades) have no timeout, since they
+//     are expected to be long-lived.
+//  2. The service's timeoutAnnotation, if it is valid.
+//  3. The server's backendTimeout.
+func (s *server) resolveTimeout(r *http.Request, service *corev1.Service) time.Duration {
+	if isStreamingRequest(r) {
+		return 0
+	}
+	if value, ok := service.Annotations[timeoutAnnotation]; ok {
+		timeout, err := time.ParseDuration(value)
+		if err == nil && timeout >= 0 {
+			return timeout
+		}
+		s.logger.warning("ignoring invalid annotation", logFields{"namespace": service.Namespace,
+			"service": service.Name, "annotation": timeoutAnnotation, "value": value})
+	}
+	return s.backendTimeout
+}
+
+// Returns true if r is expected to produce a long-lived streaming response.
+func isStreamingRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		if strings.Contains(accept, "text/event-stream") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the service with metadata UID uid. The Kubernetes API cannot get objects by UID, so
+// this lists all services and searches them.
+func (s *server) getByUID(ctx context.Context, uid string) (*corev1.Service, error) {
+	services, err := s.services.list(ctx, s.listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for i := range services.Items {
+		if string(services.Items[i].UID) == uid {
+			return &services.Items[i], nil
+		}
+	}
+	return nil, errors.NewNotFound(corev1.Resource("services"), uid)
+}
+
 func (s *server) proxyRewriter(resp *http.Response) error {
 	origData, ok := resp.Request.Context().Value(origRequestDataContextKey{}).(origRequestData)
 	if !ok {
 		return fmt.Errorf("proxy error: original request data not found in context")
 	}
-	rootPath := fmt.Sprintf("/%s/%s/%d", origData.namespace, origData.service, origData.port)
+	rootPath := origData.rootPath
+	fields := func(extra logFields) logFields {
+		extra["namespace"] = origData.namespace
+		extra["service"] = origData.service
+		extra["port"] = origData.port
+		return extra
+	}
 
 	// rewrite the location header
 	const locationHeader = "Location"
-	if resp.Header.Get(locationHeader) != "" {
-		newLocation := rewriteURL(resp.Header.Get(locationHeader), rootPath)
-		log.Printf("proxy rewrote Location: %#v -> %#v", resp.Header.Get(locationHeader), newLocation)
-		resp.Header.Set(locationHeader, newLocation)
+	if location := resp.Header.Get(locationHeader); location != "" {
+		metricLabels := origData.metricLabels
+		if _, err := url.Parse(location); err != nil {
+			// a misbehaving backend: send it unchanged, since we cannot tell what it means
+			s.logger.warning("could not parse Location; not rewriting", fields(logFields{
+				"location": location, "error": err.Error()}))
+			s.metrics.observeLocation(metricLabels.namespace, metricLabels.service, locationInvalid)
+		} else {
+			newLocation := rewriteURLFrom(stripProxyHost(location, s.rewriteOptions.proxyHosts),
+				rootPath, origData.destPath)
+			result := locationUnchanged
+			if newLocation != location {
+				result = locationRewritten
+			}
+			s.metrics.observeLocation(metricLabels.namespace, metricLabels.service, result)
+			s.logger.info("proxy rewrote Location", fields(logFields{
+				"from": location, "to": newLocation, "result": result}))
+			resp.Header.Set(locationHeader, newLocation)
+		}
+	}
+	if refresh := resp.Header.Get(refreshHeader); refresh != "" {
+		newRefresh := rewriteRefresh(refresh, rootPath, origData.destPath, s.rewriteOptions.proxyHosts)
+		if newRefresh != refresh {
+			s.logger.info("proxy rewrote Refresh", fields(logFields{"from": refresh, "to": newRefresh}))
+			resp.Header.Set(refreshHeader, newRefresh)
+		}
+	}
+
+	s.addSunsetHeaders(resp.Header, origData)
+
+	setCookies := resp.Header.Values("Set-Cookie")
+	for i, setCookie := range setCookies {
+		setCookie = rewriteCookiePath(setCookie, rootPath)
+		setCookies[i] = rewriteSetCookie(setCookie, s.cookieSameSite)
+	}
+
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != "" {
+		resp.Header.Set("Content-Disposition", sanitizeContentDisposition(disposition))
+	}
+
+	if s.noCacheProxiedContent {
+		contentType := resp.Header.Get("Content-Type")
+		if forcedType := origData.annotations[forceContentTypeAnnotation]; forcedType != "" {
+			contentType = forcedType
+		}
+		if isHTMLContentType(contentType) {
+			setNoStore(resp.Header)
+		}
+	}
+
+	if hasNoTransform(resp.Header) {
+		s.logger.info("not rewriting body: backend sent Cache-Control: no-transform", fields(logFields{}))
+		return nil
+	}
+
+	if isOpenAPIPath(origData.annotations, origData.destPath) {
+		s.logger.info("rewriting OpenAPI document", fields(logFields{
+			"dest_path": origData.destPath, "root": rootPath}))
+		if ok, err := s.decodeResponseBody(resp); !ok || err != nil {
+			return err
+		}
+		return s.rewriteOpenAPIResponse(resp, rootPath)
+	}
+
+	if forcedType := origData.annotations[forceContentTypeAnnotation]; forcedType != "" {
+		s.logger.info("proxy forcing Content-Type", fields(logFields{
+			"from": resp.Header.Get("Content-Type"), "to": forcedType}))
+		resp.Header.Set("Content-Type", forcedType)
 	}
 
 	// TODO: check params for charset
 	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
 	if err != nil {
-		log.Printf("warning: could not parse Content-Type: %s = %s; not rewriting links",
-			resp.Header.Get("Content-Type"), err.Error())
+		s.logger.warning("could not parse Content-Type; not rewriting links", fields(logFields{
+			"content_type": resp.Header.Get("Content-Type"), "error": err.Error()}))
+	}
+	if mediaType == cssMediaType {
+		s.logger.info("rewriting CSS paths", fields(logFields{"root": rootPath}))
+		if ok, err := s.decodeResponseBody(resp); !ok || err != nil {
+			return err
+		}
+		css, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		setRewrittenBody(resp, []byte(rewriteCSSURLs(string(css), rootPath)))
+		return nil
+	}
+	if rewriteJSON, keys := rewriteJSONKeys(origData.annotations); rewriteJSON &&
+		isJSONContentType(resp.Header.Get("Content-Type")) {
+		s.logger.info("rewriting JSON paths", fields(logFields{"root": rootPath}))
+		if ok, err := s.decodeResponseBody(resp); !ok || err != nil {
+			return err
+		}
+		return rewriteJSONResponse(resp, rootPath, keys)
 	}
-	if mediaType != htmlMediaType {
+	if mediaType != htmlMediaType && mediaType != xhtmlMediaType {
+		return nil
+	}
+	if s.rewriteStatusCodes != nil && !s.rewriteStatusCodes[resp.StatusCode] {
+		s.logger.info("not rewriting HTML", fields(logFields{"status": resp.StatusCode}))
 		return nil
 	}
 
@@ -276,28 +1150,94 @@ func (s *server) proxyRewriter(resp *http.Response) error {
 	// However, Google Cloud Ingress's automatic TLS certificates do not support wildcard domains,
 	// so let's write a bit more code to make this easier to use
 
-	log.Printf("rewriting HTML paths to root=%s", rootPath)
+	s.logger.info("rewriting HTML paths", fields(logFields{"root": rootPath}))
+	if ok, err := s.decodeResponseBody(resp); !ok || err != nil {
+		return err
+	}
+
+	for _, linkHint := range s.linkHints {
+		resp.Header.Add("Link", rewriteLinkValue(linkHint, rootPath))
+	}
 
 	buf := &bytes.Buffer{}
-	err = rewriteAbsolutePathLinks(buf, resp.Body, rootPath)
+	opts := s.rewriteOptions
+	opts.banner = namespaceBanner(s.banners, origData.namespace)
+	opts.destPath = origData.destPath
+	err = rewriteAbsolutePathLinks(buf, resp.Body, rootPath, opts)
 	if err != nil {
 		return err
 	}
 
-	resp.Header.Del("Content-Length")
-	resp.Body = io.NopCloser(buf)
+	setRewrittenBody(resp, buf.Bytes())
 	return nil
 }
 
+// Replaces the body of resp with the rewritten body, closing the original. Content-Length is set
+// to the rewritten length, including for empty bodies, unless the response has no body.
+func setRewrittenBody(resp *http.Response, body []byte) {
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified {
+		// no body is sent, and the length of the rewritten GET response is unknown
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return
+	}
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// Returns true if contentType is HTML or XHTML.
+func isHTMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == htmlMediaType || mediaType == xhtmlMediaType)
+}
+
+// Replaces the backend's caching headers so shared caches and browsers do not store the response.
+// Keeps no-transform, which also stops the proxy from rewriting the body.
+func setNoStore(header http.Header) {
+	cacheControl := "no-store, private"
+	if hasNoTransform(header) {
+		cacheControl += ", no-transform"
+	}
+	header.Set("Cache-Control", cacheControl)
+	header.Del("Expires")
+}
+
+// Returns true if header contains Cache-Control: no-transform, which forbids intermediaries
+// from modifying the body.
+func hasNoTransform(header http.Header) bool {
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// URL schemes that do not refer to paths on a server, which must never be rewritten. These are
+// checked before parsing since some (e.g. javascript:) are often not valid URLs.
+var nonHTTPSchemes = []string{"mailto:", "tel:", "javascript:", "data:", "blob:"}
+
 // Rewrites URL string so that any absolute path references are based on rootPath.
 func rewriteURL(urlString string, rootPath string) string {
+	lowerURL := strings.ToLower(strings.TrimSpace(urlString))
+	for _, scheme := range nonHTTPSchemes {
+		if strings.HasPrefix(lowerURL, scheme) {
+			return urlString
+		}
+	}
+
 	u, err := url.Parse(urlString)
 	if err != nil {
-		log.Printf("warning: skipping invalid URL: %s: %s", urlString, err.Error())
+		// leave invalid URLs unchanged: we cannot tell what they refer to
 		return urlString
 	}
-	if u.IsAbs() {
-		// absolute links to other hosts
+	if u.IsAbs() || u.Host != "" {
+		// absolute links to other hosts, including scheme-relative links "//host/path"
 		return urlString
 	}
 	if u.Path == "" {
@@ -305,30 +1245,262 @@ func rewriteURL(urlString string, rootPath string) string {
 		return urlString
 	}
 	if u.Path[0] != '/' {
-		// relative path references: do not rewrite
-		// TODO: we might need to rewrite "../" references that could go back too far but skip for now
+		// relative path references resolve under rootPath, unless "../" goes above it: see
+		// rewriteURLFrom
 		return urlString
 	}
 
-	origPath := u.Path
-	u.Path = path.Join(rootPath, u.Path)
+	// clean before checking and joining, so "/.." cannot escape rootPath
+	cleanPath := path.Clean(u.Path)
+	if cleanPath == rootPath || strings.HasPrefix(cleanPath, rootPath+"/") {
+		// already rewritten, e.g. a backend that honors X-Forwarded-Prefix: do not prefix twice
+		return urlString
+	}
 
-	// ensure we keep the same trailing slashes
-	if origPath[len(origPath)-1] == '/' && u.Path[len(u.Path)-1] != '/' {
-		u.Path += "/"
+	// Only the path changes: copy the query and fragment exactly, since re-encoding them could
+	// change them. EscapedPath keeps the original encoding of the path, e.g. %2F.
+	suffix := ""
+	if i := strings.IndexAny(urlString, "?#"); i >= 0 {
+		suffix = urlString[i:]
+	}
+	escapedPath := u.EscapedPath()
+	isDirectory := cleanPath == "/" || strings.HasSuffix(escapedPath, "/") ||
+		strings.HasSuffix(escapedPath, "/.") || strings.HasSuffix(escapedPath, "/..")
+	newPath := path.Join(rootPath, path.Clean(escapedPath))
+
+	// keep directory paths like "/dir/" as directories, since relative links resolve against them;
+	// other paths like "/dir" and "/dir/index.html" are kept as they are
+	if isDirectory && !strings.HasSuffix(newPath, "/") {
+		newPath += "/"
+	}
+	return newPath + suffix
+}
+
+// If urlString is an absolute URL to one of proxyHosts (lowercase hostnames, optionally with a
+// port), returns it without the scheme and host so it is rewritten like any absolute path.
+// Otherwise returns urlString unchanged.
+func stripProxyHost(urlString string, proxyHosts map[string]bool) string {
+	if len(proxyHosts) == 0 {
+		return urlString
+	}
+	u, err := url.Parse(strings.TrimSpace(urlString))
+	if err != nil || u.Host == "" || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+		return urlString
+	}
+	if !proxyHosts[strings.ToLower(u.Host)] && !proxyHosts[strings.ToLower(u.Hostname())] {
+		return urlString
+	}
+	u.Scheme = ""
+	u.User = nil
+	u.Host = ""
+	if u.Path == "" {
+		u.Path = "/"
 	}
 	return u.String()
 }
 
-// maps tag to URL attribute that should be rewritten by rewriteRelativeLinks
-var attrRewrites = map[atom.Atom]string{
-	atom.A:    "href",
-	atom.Form: "action",
+// Like rewriteURL, but also rewrites relative paths that would resolve above rootPath from the
+// page at destPath, e.g. "../../x" from "/dir/page". These become absolute paths, clamped so they
+// cannot go above rootPath.
+func rewriteURLFrom(urlString string, rootPath string, destPath string) string {
+	u, err := url.Parse(urlString)
+	if err != nil || u.IsAbs() || u.Host != "" || u.Path == "" || u.Path[0] == '/' {
+		return rewriteURL(urlString, rootPath)
+	}
+	if destPath == "" {
+		destPath = "/"
+	}
+
+	// resolve the way the browser does, against the proxied page's path
+	resolved := path.Join(path.Dir(rootPath+destPath), u.Path)
+	if resolved == rootPath || strings.HasPrefix(resolved, rootPath+"/") {
+		return urlString
+	}
+
+	// resolve against destPath instead, where path.Join stops ".." at "/"
+	isDirectory := u.Path == "." || u.Path == ".." || strings.HasSuffix(u.Path, "/") ||
+		strings.HasSuffix(u.Path, "/.") || strings.HasSuffix(u.Path, "/..")
+	u.Path = path.Join(path.Dir(destPath), u.Path)
+	if isDirectory && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return rewriteURL(u.String(), rootPath)
+}
+
+// Splits a Link header value into its comma-separated link-values. Commas inside the <URI> do
+// not separate values.
+func splitLinkValues(header string) []string {
+	var values []string
+	inURI := false
+	start := 0
+	for i, c := range header {
+		switch {
+		case c == '<':
+			inURI = true
+		case c == '>':
+			inURI = false
+		case c == ',' && !inURI:
+			values = append(values, strings.TrimSpace(header[start:i]))
+			start = i + 1
+		}
+	}
+	values = append(values, strings.TrimSpace(header[start:]))
+
+	out := values[:0]
+	for _, value := range values {
+		if value != "" {
+			out = append(out, value)
+		}
+	}
+	return out
+}
+
+// Rewrites the <URI> in a single Link header link-value (e.g. "</a.css>; rel=preload").
+func rewriteLinkValue(linkValue string, rootPath string) string {
+	start := strings.IndexByte(linkValue, '<')
+	end := strings.IndexByte(linkValue, '>')
+	if start < 0 || end < start {
+		return linkValue
+	}
+	return linkValue[:start+1] + rewriteURL(linkValue[start+1:end], rootPath) + linkValue[end:]
+}
+
+// maps tag to URL attributes that should be rewritten by rewriteRelativeLinks
+var attrRewrites = map[atom.Atom][]string{
+	atom.A:      {"href"},
+	atom.Form:   {"action"},
+	atom.Img:    {"src"},
+	atom.Link:   {"href"},
+	atom.Script: {"src"},
+	// the base URL for all relative links: relative values resolve under the proxied page's path
+	atom.Base: {"href"},
+	// media elements; track's srclang, label and kind are not URLs
+	atom.Video:  {"src", "poster"},
+	atom.Audio:  {"src"},
+	atom.Source: {"src"},
+	atom.Track:  {"src"},
+}
+
+// Returns true if values contains value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// maps tag to srcset-style attribute that should be rewritten with rewriteSrcset
+var srcsetRewrites = map[atom.Atom]string{
+	// <link rel="preload" as="image" imagesrcset="..."> (imagesizes does not contain URLs)
+	atom.Link: "imagesrcset",
+	atom.Img:  "srcset",
+	// <picture><source srcset="...">
+	atom.Source: "srcset",
+}
+
+// <link> rel values where href is an origin (e.g. "/" for this server), not a resource path
+var originLinkRels = map[string]bool{
+	"preconnect":   true,
+	"dns-prefetch": true,
+}
+
+// Returns true if t is a <link> whose href is an origin, which must not be path-prefixed.
+func isOriginLink(t *html.Token) bool {
+	if t.DataAtom != atom.Link {
+		return false
+	}
+	for _, attr := range t.Attr {
+		if attr.Key == "rel" {
+			for _, rel := range strings.Fields(strings.ToLower(attr.Val)) {
+				if originLinkRels[rel] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Options controlling which attributes rewriteAbsolutePathLinks rewrites.
+type rewriteOptions struct {
+	// Rewrite the data-src and data-srcset attributes used by lazy-loading libraries. These are
+	// a convention, not a standard, so this is off by default.
+	lazyAttrs bool
+	// Add rel="noopener" to links with target="_blank", so the opened page cannot access this
+	// one with window.opener. Other target values are left untouched.
+	noopener bool
+	// If set, HTML inserted at the start of <body>.
+	banner string
+	// Path of the page on the backend, used to rewrite relative links that go above the root.
+	destPath string
+	// Absolute URLs to these hosts are rewritten as paths; see stripProxyHost.
+	proxyHosts map[string]bool
+}
+
+// Adds noopener to the rel attribute of t if it is a link that opens a new window. Returns true
+// if t was modified.
+func addNoopener(t *html.Token) bool {
+	if t.DataAtom != atom.A && t.DataAtom != atom.Area {
+		return false
+	}
+	blankTarget := false
+	relIndex := -1
+	for i, attr := range t.Attr {
+		if attr.Key == "target" && strings.EqualFold(attr.Val, "_blank") {
+			blankTarget = true
+		} else if attr.Key == "rel" {
+			relIndex = i
+		}
+	}
+	if !blankTarget {
+		return false
+	}
+	if relIndex < 0 {
+		t.Attr = append(t.Attr, html.Attribute{Key: "rel", Val: "noopener"})
+		return true
+	}
+	for _, rel := range strings.Fields(t.Attr[relIndex].Val) {
+		if strings.EqualFold(rel, "noopener") {
+			return false
+		}
+	}
+	t.Attr[relIndex].Val = strings.TrimSpace(t.Attr[relIndex].Val + " noopener")
+	return true
+}
+
+// Rewrites a URL in an attribute such as href: absolute URLs to -proxyHosts and absolute paths
+// start with rootPath, and relative paths cannot go above it.
+func (opts rewriteOptions) rewriteAttrURL(link string, rootPath string) string {
+	return rewriteURLFrom(stripProxyHost(link, opts.proxyHosts), rootPath, opts.destPath)
+}
+
+// Rewrites each URL in a srcset attribute, which is a comma-separated list of "url descriptor"
+// image candidates, like links. The descriptors and whitespace are preserved.
+func rewriteSrcset(srcset string, rootPath string, opts rewriteOptions) string {
+	const whitespace = " \t\n\r\f"
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		trimmed := strings.TrimLeft(candidate, whitespace)
+		leading := candidate[:len(candidate)-len(trimmed)]
+		urlEnd := strings.IndexAny(trimmed, whitespace)
+		if urlEnd < 0 {
+			urlEnd = len(trimmed)
+		}
+		if urlEnd == 0 {
+			continue
+		}
+		candidates[i] = leading + opts.rewriteAttrURL(trimmed[:urlEnd], rootPath) + trimmed[urlEnd:]
+	}
+	return strings.Join(candidates, ",")
 }
 
 // Rewrites all absolute paths in the HTML document in r to start with rootPath.
-func rewriteAbsolutePathLinks(w io.Writer, r io.Reader, rootPath string) error {
+func rewriteAbsolutePathLinks(w io.Writer, r io.Reader, rootPath string, opts rewriteOptions) error {
 	tokenizer := html.NewTokenizer(r)
+	inStyle := false
+	inJSONLD := false
 	for {
 		tokenType := tokenizer.Next()
 		if tokenType == html.ErrorToken {
@@ -337,30 +1509,83 @@ func rewriteAbsolutePathLinks(w io.Writer, r io.Reader, rootPath string) error {
 			}
 			return tokenizer.Err()
 		}
+		// Raw is only valid until the next call to Token
+		raw := append([]byte(nil), tokenizer.Raw()...)
 		t := tokenizer.Token()
-		rewriteAttr := attrRewrites[t.DataAtom]
-		if rewriteAttr != "" {
-			for i, attr := range t.Attr {
-				if attr.Key == rewriteAttr {
-					newURL := rewriteURL(attr.Val, rootPath)
-					log.Printf("rewriting %s.%s=%#v -> %#v", t.DataAtom, attr.Key, attr.Val, newURL)
-					t.Attr[i].Val = newURL
-				}
+		if t.DataAtom == atom.Style {
+			inStyle = tokenType == html.StartTagToken
+		} else if inStyle && tokenType == html.TextToken {
+			// write CSS as text: t.String() would escape it
+			raw = []byte(rewriteCSSURLs(string(raw), rootPath))
+		} else if t.DataAtom == atom.Script {
+			inJSONLD = isJSONLDScript(&t)
+		} else if inJSONLD && tokenType == html.TextToken {
+			raw = []byte(rewriteJSONLD(string(raw), rootPath))
+		}
+		modified := false
+		rewriteAttrs := attrRewrites[t.DataAtom]
+		if isOriginLink(&t) {
+			rewriteAttrs = nil
+		}
+		srcsetAttr := srcsetRewrites[t.DataAtom]
+		for i, attr := range t.Attr {
+			var newVal string
+			switch {
+			case containsString(rewriteAttrs, attr.Key):
+				newVal = opts.rewriteAttrURL(attr.Val, rootPath)
+			case srcsetAttr != "" && attr.Key == srcsetAttr:
+				newVal = rewriteSrcset(attr.Val, rootPath, opts)
+			case opts.lazyAttrs && attr.Key == "data-src":
+				newVal = opts.rewriteAttrURL(attr.Val, rootPath)
+			case opts.lazyAttrs && attr.Key == "data-srcset":
+				newVal = rewriteSrcset(attr.Val, rootPath, opts)
+			case attr.Key == "style":
+				newVal = rewriteCSSURLs(attr.Val, rootPath)
+			case attr.Key == "content" && isMetaRefresh(&t):
+				newVal = rewriteRefresh(attr.Val, rootPath, opts.destPath, opts.proxyHosts)
+			default:
+				continue
+			}
+			if newVal == attr.Val {
+				continue
 			}
+			t.Attr[i].Val = newVal
+			modified = true
+		}
+		if opts.noopener && addNoopener(&t) {
+			modified = true
 		}
 
-		// t.String() incorrectly escapes <script> content
-		// https://github.com/golang/go/issues/7929
-		var content string
-		if tokenType == html.TextToken {
-			content = t.Data
-		} else {
-			content = t.String()
+		// Write unmodified tokens exactly as they were. t.String() lowercases names, which breaks
+		// XHTML, and incorrectly escapes <script> content: https://github.com/golang/go/issues/7929
+		content := raw
+		if modified {
+			content = []byte(t.String())
 		}
-		_, err := w.Write([]byte(content))
+		_, err := w.Write(content)
 		if err != nil {
 			return err
 		}
+
+		if opts.banner != "" && tokenType == html.StartTagToken && t.DataAtom == atom.Body {
+			_, err = io.WriteString(w, bannerHTML(opts.banner))
+			if err != nil {
+				return err
+			}
+			opts.banner = ""
+		}
+	}
+	return nil
+}
+
+// Returns an error if healthPath cannot be used as the health check path.
+func validateHealthPath(healthPath string) error {
+	if !strings.HasPrefix(healthPath, "/") || healthPath == "/" {
+		return fmt.Errorf("health path %#v must start with / and not be /", healthPath)
+	}
+	if servicePattern.MatchString(healthPath) {
+		return fmt.Errorf("health path %#v must not look like a proxy path /namespace/service/port",
+			healthPath)
 	}
 	return nil
 }
@@ -368,24 +1593,186 @@ func rewriteAbsolutePathLinks(w io.Writer, r io.Reader, rootPath string) error {
 func (s *server) makeSecureHandler(iapAudience string) http.Handler {
 	insecureMux := http.NewServeMux()
 	insecureMux.HandleFunc("/", s.rootHandler)
-	insecureMux.HandleFunc("/health", s.healthHandler)
-	secureMux := iap.Required(iapAudience, insecureMux)
+	insecureMux.HandleFunc(s.healthPath, s.healthHandler)
+	insecureMux.HandleFunc("/admin/reachability", s.reachabilityHandler)
+	insecureMux.HandleFunc("/admin/maintenance", s.maintenanceHandler)
+	insecureMux.HandleFunc("/api/services", s.servicesAPIHandler)
+	insecureMux.HandleFunc("/api/services.csv", s.servicesCSVHandler)
+	insecureMux.HandleFunc("/api/namespaces", s.namespacesAPIHandler)
+	// health checks are served below without the rate limit
+	secureMux := iap.Required(iapAudience, s.rateLimited(insecureMux))
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if isRootHealthCheck(r) || r.URL.Path == "/health" {
+		if isRootHealthCheck(r) || s.healthCheckHeader.matches(r) || r.URL.Path == s.healthPath {
 			s.healthHandler(w, r)
 			return
 		}
+		if r.URL.Path == readyPath {
+			s.readyHandler(w, r)
+			return
+		}
+		if r.URL.Path == metricsPath {
+			s.metricsHandler(w, r)
+			return
+		}
+		if r.URL.Path == "/robots.txt" {
+			s.robotsHandler(w, r)
+			return
+		}
 
 		secureMux.ServeHTTP(w, r)
 	})
+	if s.basePath != "" {
+		return s.stripBasePath(handler)
+	}
 	return handler
 }
 
 func main() {
 	// https://cloud.google.com/iap/docs/signed-headers-howto#verifying_the_jwt_payload
 	iapAudience := flag.String("iapAudience", "", "Identity-Aware Proxy audience (aud) field (REQUIRED)")
+	configFile := flag.String("config", "",
+		"YAML file mapping flag names to values (e.g. backendTimeout: 30s); flags on the command line override it")
+	rewriteLazyAttrs := flag.Bool("rewriteLazyAttrs", false,
+		"Rewrite the data-src and data-srcset attributes used by lazy-loading libraries")
+	upstreamTimeout := flag.Duration("upstreamTimeout", 0,
+		"Maximum time to connect to a backend and then to wait for its response headers (0 for none); "+
+			"unlike -backendTimeout, this also applies to streaming requests")
+	backendTimeout := flag.Duration("backendTimeout", 0,
+		"Default timeout for proxied requests (0 for none); services may override it with the "+
+			timeoutAnnotation+" annotation")
+	allowIndexing := flag.Bool("allowIndexing", false,
+		"Serve a robots.txt that allows crawlers to index the proxy")
+	maintenance := flag.Bool("maintenance", false,
+		"Start in maintenance mode: proxying returns 503 until disabled with /admin/maintenance")
+	maintenanceAdmins := flag.String("maintenanceAdmins", "",
+		"Comma-separated emails of IAP users allowed to use /admin/maintenance")
+	logFormat := flag.String("logFormat", "text",
+		"Log format: text, json for one JSON object per line, or gcp to also write a structured access log line for each request")
+	forwardHeaders := flag.String("forwardHeaders", "",
+		"If set, a comma-separated list of the only request headers forwarded to backends")
+	fieldSelector := flag.String("fieldSelector", "",
+		"Kubernetes field selector to restrict listed services (e.g. metadata.namespace!=kube-system)")
+	healthPath := flag.String("healthPath", defaultHealthPath,
+		"Path of the health check endpoint, which is not protected by IAP")
+	healthCheckHeaderFlag := flag.String("healthCheckHeader", "",
+		"Treat requests to / with this header as health checks without auth; either Name or Name:value")
+	cookieSameSite := flag.String("cookieSameSite", "",
+		"If set, the SameSite attribute for cookies set by backends: Lax, Strict, or None")
+	linkHints := flag.String("linkHints", "",
+		"Link header added to proxied HTML responses, e.g. \"</>; rel=prefetch\"; paths are prefixed "+
+			"with the service's proxy path")
+	sortBy := flag.String("sortBy", sortByNamespaceName,
+		"Order of the service list: ns-name (grouped by namespace), namespace (grouped by namespace, "+
+			"in API order), or name (all namespaces together)")
+	backendInsecureSkipVerify := flag.Bool("backendInsecureSkipVerify", false,
+		"Do not verify the certificates of HTTPS backends, e.g. to permit self-signed certificates")
+	maxDialsPerBackend := flag.Int("maxDialsPerBackend", 0,
+		"Maximum concurrent connection attempts to each backend ClusterIP:port (0 for no limit)")
+	slowRequestThreshold := flag.Duration("slowRequestThreshold", 0,
+		"Log a warning for proxied requests that take longer than this (0 to disable)")
+	addNoopener := flag.Bool("addNoopener", false,
+		"Add rel=\"noopener\" to proxied links with target=\"_blank\"")
+	appendUserAgent := flag.Bool("appendUserAgent", false,
+		"Append kubewebproxy/(version) to the User-Agent sent to backends")
+	redactQueryParams := flag.String("redactQueryParams", "",
+		"Comma-separated query parameter names (e.g. token,api_key) with values redacted in logs")
+	rewriteStatusCodes := flag.String("rewriteStatusCodes", "",
+		"Comma-separated response status codes (e.g. 200,201) of HTML responses to rewrite; default all")
+	backendAddrTemplate := flag.String("backendAddrTemplate", "",
+		"Go text/template for the backend host:port, with fields .Namespace .Service .ClusterIP .Port (default {{.ClusterIP}}:{{.Port}})")
+	useInformer := flag.Bool("useInformer", false,
+		"Cache services locally by watching the Kubernetes API, instead of requesting them for each page or proxied request")
+	serviceGetCacheTTL := flag.Duration("serviceGetCacheTTL", 0,
+		"Reuse service metadata fetched when proxying for this long (e.g. 5s), reducing API calls (0 to disable)")
+	bannerFile := flag.String("bannerFile", "",
+		"JSON file mapping namespace (or * for others) to banner HTML shown at the top of proxied pages")
+	namespace := flag.String("namespace", "",
+		"Only list and proxy services in this namespace, for a proxy per tenant (default all namespaces)")
+	sameNamespaceOnly := flag.Bool("sameNamespaceOnly", false,
+		"Only list and proxy services in the proxy's own namespace (from $POD_NAMESPACE or the service account)")
+	shutdownGracePeriod := flag.Duration("shutdownGracePeriod", 25*time.Second,
+		"On SIGTERM, time to wait for requests and websockets to finish before closing them")
+	generateTraceIDs := flag.Bool("generateTraceIDs", false,
+		"Add an "+cloudTraceHeader+" header with a new trace ID to proxied requests that do not have one")
+	requireAnnotation := flag.Bool("requireAnnotation", false,
+		"Only list and proxy services with the annotation "+exposeAnnotation+`: "true"`)
+	denyServices := flag.String("denyServices", "",
+		"Comma-separated services (namespace/name or namespace/*) that are never listed or proxied; overrides all other rules")
+	allowServices := flag.String("allowServices", "",
+		"Comma-separated services (namespace/name or namespace/*) that are always listed and proxied, "+
+			"ignoring -allowNamespaces, -requireAnnotation and -serviceSelector")
+	allowNamespaces := flag.String("allowNamespaces", "",
+		"If set, comma-separated namespaces: services in other namespaces are not listed or proxied")
+	serviceSelector := flag.String("serviceSelector", "",
+		"Kubernetes label selector (e.g. expose=true): services that do not match are not listed or proxied")
+	proxyHosts := flag.String("proxyHosts", "",
+		"Comma-separated hostnames of this proxy: absolute links to them are rewritten like absolute paths")
+	hiddenNamespaces := flag.String("hiddenNamespaces", "",
+		"Comma-separated namespaces (e.g. kube-system) not shown in the service list; their services can still be proxied")
+	trustedProxies := flag.String("trustedProxies", defaultTrustedProxyCIDRs,
+		"Comma-separated CIDRs of proxies allowed to set Forwarded and X-Forwarded-* headers; removed from other clients")
+	serviceListCacheTTL := flag.Duration("serviceListCacheTTL", 0,
+		"Reuse the service list for this long (e.g. 10s), loading it at startup (0 to disable)")
+	listenAddr := flag.String("listenAddr", "",
+		"Address to listen on (e.g. 127.0.0.1:8080); overrides the "+portEnvVar+" environment variable (default :$"+portEnvVar+")")
+	maxWebsockets := flag.Int("maxWebsockets", 0,
+		"Maximum number of concurrent proxied websocket connections (0 for unlimited); more return 503")
+	websocketIdleTimeout := flag.Duration("websocketIdleTimeout", 0,
+		"Close proxied websocket connections with no data in either direction for this long (0 for none)")
+	linkPortNames := flag.Bool("linkPortNames", false,
+		"Link to named ports by name (e.g. /ns/svc/http/) in the service list, so links survive port number changes")
+	directEndpoints := flag.Bool("directEndpoints", false,
+		"Connect to a ready endpoint (pod) of each service instead of its ClusterIP; headless services always are")
+	proxyPods := flag.Bool("proxyPods", false,
+		"Proxy directly to pods with /_pods/namespace/pod/port/; requires permission to get pods")
+	noCacheProxiedContent := flag.Bool("noCacheProxiedContent", false,
+		"Replace the cache headers of proxied HTML with Cache-Control: no-store, private, so caches do not store "+
+			"authenticated pages; other responses (e.g. images and scripts) are unchanged")
+	basePath := flag.String("basePath", "",
+		"Path prefix the proxy is served under (e.g. /kwp when an Ingress routes /kwp/* to it); links include it")
+	rateLimit := flag.Float64("rateLimit", 0,
+		"Maximum requests per second from each user (by IAP email, or by IP), over -rateBurst; more return 429 (0 for no limit)")
+	rateBurst := flag.Int("rateBurst", 20,
+		"Number of requests each user can make at once before -rateLimit applies")
+	injectHeaderSecrets := flag.Bool("injectHeaderSecrets", false,
+		"Allow services to set request headers from Secrets with the "+injectHeaderSecretAnnotation+
+			" annotation; requires permission to get secrets")
+	secretCacheTTL := flag.Duration("secretCacheTTL", defaultSecretCacheTTL,
+		"Reuse secrets read for -injectHeaderSecrets for this long")
+	groupByLabel := flag.String("groupByLabel", "",
+		"Group the service list by the value of this label (e.g. team) instead of by namespace")
+	timeouts := defaultServerTimeouts
+	flag.DurationVar(&timeouts.readHeader, "readHeaderTimeout", timeouts.readHeader,
+		"Maximum time to read client request headers (0 for none)")
+	flag.DurationVar(&timeouts.read, "readTimeout", timeouts.read,
+		"Maximum time to read an entire client request including the body (0 for none); this limits uploads")
+	flag.DurationVar(&timeouts.write, "writeTimeout", timeouts.write,
+		"Maximum time to write a response (0 for none); this limits streaming responses")
+	flag.DurationVar(&timeouts.idle, "idleTimeout", timeouts.idle,
+		"Maximum time to keep idle client keep-alive connections open (0 for none)")
 	flag.Parse()
+	if *configFile != "" {
+		err := loadConfigFile(*configFile, flag.CommandLine)
+		if err != nil {
+			panic(fmt.Sprintf("invalid -config=%#v: %s", *configFile, err.Error()))
+		}
+	}
+	err := validateHealthPath(*healthPath)
+	if err != nil {
+		panic(err)
+	}
+	if *sortBy != sortByNamespaceName && *sortBy != sortByName && *sortBy != sortByNamespace {
+		panic(fmt.Sprintf("invalid -sortBy=%#v", *sortBy))
+	}
+	sameSite, err := parseSameSite(*cookieSameSite)
+	if err != nil {
+		panic(err)
+	}
+	healthCheckHeader, err := parseHealthCheckHeader(*healthCheckHeaderFlag)
+	if err != nil {
+		panic(fmt.Sprintf("invalid -healthCheckHeader=%#v: %s", *healthCheckHeaderFlag, err.Error()))
+	}
 
 	// connect to the Kubernetes APIS
 	config, err := rest.InClusterConfig()
@@ -400,45 +1787,284 @@ func main() {
 	// crash early if we do not have the correct permission
 	// TODO: This is probably bad: we will crash on startup if the master is down, but it
 	// does make it easier to debug permissions errors. Figure out a better option?
-	s := newServer(&kubernetesAPIClient{clientset})
+	apiClient := &kubernetesAPIClient{clientset}
+	s := newServer(apiClient)
+	switch *logFormat {
+	case "text", "gcp":
+	case "json":
+		s.logger = newJSONLogger(os.Stderr)
+	default:
+		panic(fmt.Sprintf("invalid -logFormat=%#v; must be text, json, or gcp", *logFormat))
+	}
+	if *proxyPods {
+		s.pods = apiClient
+	}
+	s.endpoints = apiClient
+	s.listOptions.fieldSelector = *fieldSelector
+	s.listOptions.namespace = *namespace
+	if *sameNamespaceOnly {
+		if *namespace != "" {
+			panic(fmt.Sprintf("invalid -namespace=%#v: cannot be used with -sameNamespaceOnly", *namespace))
+		}
+		s.listOptions.namespace, err = podNamespace(serviceAccountNamespaceFile)
+		if err != nil {
+			panic(err)
+		}
+		s.logger.info("only proxying services in one namespace", logFields{"namespace": s.listOptions.namespace})
+	}
+	s.rewriteOptions.lazyAttrs = *rewriteLazyAttrs
+	s.rewriteOptions.noopener = *addNoopener
+	s.backendTimeout = *backendTimeout
+	s.allowIndexing = *allowIndexing
+	s.maintenance.Store(*maintenance)
+	if *maintenanceAdmins != "" {
+		s.maintenanceAdmins = map[string]bool{}
+		for _, email := range splitList(*maintenanceAdmins) {
+			s.maintenanceAdmins[email] = true
+		}
+	}
+	s.healthPath = *healthPath
+	s.healthCheckHeader = healthCheckHeader
+	s.cookieSameSite = sameSite
+	s.linkHints = splitLinkValues(*linkHints)
+	s.sortBy = *sortBy
+	s.groupByLabel = *groupByLabel
+	s.slowRequestThreshold = *slowRequestThreshold
+	s.appendUserAgent = *appendUserAgent
+	s.linkPortNames = *linkPortNames
+	s.maxWebsockets = *maxWebsockets
+	s.websocketIdleTimeout = *websocketIdleTimeout
+	s.requireAnnotation = *requireAnnotation
+	s.directEndpoints = *directEndpoints
+	s.noCacheProxiedContent = *noCacheProxiedContent
+	s.basePath, err = normalizeBasePath(*basePath)
+	if err != nil {
+		panic(fmt.Sprintf("invalid -basePath=%#v: %s", *basePath, err.Error()))
+	}
+	if *rateLimit > 0 {
+		if *rateBurst < 1 {
+			panic(fmt.Sprintf("invalid -rateBurst=%d: must be at least 1 with -rateLimit", *rateBurst))
+		}
+		s.rateLimiter = newClientRateLimiter(*rateLimit, *rateBurst)
+	}
+	if *injectHeaderSecrets {
+		s.secrets = newCachingSecretInfo(apiClient, *secretCacheTTL)
+	}
+	s.generateTraceIDs = *generateTraceIDs
+	backendTransport := newBackendTransport(*maxDialsPerBackend, *backendInsecureSkipVerify, *upstreamTimeout)
+	s.reverseProxy.Transport = backendTransport
+	s.http10Transport = newHTTP10Transport(backendTransport)
+	if *forwardHeaders != "" {
+		s.forwardHeaders = map[string]bool{}
+		for _, name := range splitList(*forwardHeaders) {
+			s.forwardHeaders[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	if *redactQueryParams != "" {
+		s.redactQueryParams = map[string]bool{}
+		for _, name := range splitList(*redactQueryParams) {
+			s.redactQueryParams[name] = true
+		}
+	}
+	s.trustedProxies, err = parseCIDRList(*trustedProxies)
+	if err != nil {
+		panic(fmt.Sprintf("invalid -trustedProxies=%#v: %s", *trustedProxies, err.Error()))
+	}
+	if *proxyHosts != "" {
+		s.rewriteOptions.proxyHosts = map[string]bool{}
+		for _, host := range splitList(*proxyHosts) {
+			s.rewriteOptions.proxyHosts[strings.ToLower(host)] = true
+		}
+	}
+	s.denyServices, err = parseServiceSet(*denyServices)
+	if err != nil {
+		panic(fmt.Sprintf("invalid -denyServices=%#v: %s", *denyServices, err.Error()))
+	}
+	s.allowServices, err = parseServiceSet(*allowServices)
+	if err != nil {
+		panic(fmt.Sprintf("invalid -allowServices=%#v: %s", *allowServices, err.Error()))
+	}
+	if *allowNamespaces != "" {
+		s.allowNamespaces = map[string]bool{}
+		for _, namespace := range splitList(*allowNamespaces) {
+			s.allowNamespaces[namespace] = true
+		}
+	}
+	if *serviceSelector != "" {
+		s.serviceSelector, err = labels.Parse(*serviceSelector)
+		if err != nil {
+			panic(fmt.Sprintf("invalid -serviceSelector=%#v: %s", *serviceSelector, err.Error()))
+		}
+	}
+	if *hiddenNamespaces != "" {
+		s.hiddenNamespaces = map[string]bool{}
+		for _, namespace := range splitList(*hiddenNamespaces) {
+			s.hiddenNamespaces[namespace] = true
+		}
+	}
+	if *rewriteStatusCodes != "" {
+		s.rewriteStatusCodes = map[int]bool{}
+		for _, code := range splitList(*rewriteStatusCodes) {
+			status, err := strconv.Atoi(code)
+			if err != nil || http.StatusText(status) == "" {
+				panic(fmt.Sprintf("invalid -rewriteStatusCodes=%#v: %#v is not an HTTP status code",
+					*rewriteStatusCodes, code))
+			}
+			s.rewriteStatusCodes[status] = true
+		}
+	}
+	if *backendAddrTemplate != "" {
+		s.backendAddrTemplate, err = parseBackendAddrTemplate(*backendAddrTemplate)
+		if err != nil {
+			panic(fmt.Sprintf("invalid -backendAddrTemplate=%#v: %s", *backendAddrTemplate, err.Error()))
+		}
+	}
+	if *bannerFile != "" {
+		s.banners, err = loadBanners(*bannerFile)
+		if err != nil {
+			panic(fmt.Sprintf("invalid -bannerFile=%#v: %s", *bannerFile, err.Error()))
+		}
+	}
 	err = s.checkPermissions(context.Background())
 	if err != nil {
 		panic(err)
 	}
+	// the informer is already a cache, so the other caches are only used without it
+	if *useInformer {
+		start := time.Now()
+		s.services, err = newInformerServiceInfo(clientset, s.services, s.listOptions, wait.NeverStop)
+		if err != nil {
+			panic(err)
+		}
+		s.logger.info("loaded service cache", logFields{"duration_ms": time.Since(start).Milliseconds()})
+	} else {
+		if *serviceGetCacheTTL > 0 {
+			s.services = newGetCachingServiceInfo(s.services, *serviceGetCacheTTL)
+		}
+		if *serviceListCacheTTL > 0 {
+			s.services = newListCachingServiceInfo(s.services, *serviceListCacheTTL)
+			err = s.warmServiceCache(context.Background())
+			if err != nil {
+				s.logger.warning("failed to warm service cache", logFields{"error": err.Error()})
+			}
+		}
+	}
+
+	var secureHandler http.Handler = s.makeSecureHandler(*iapAudience)
+	if *logFormat == "gcp" {
+		accessLogHandler := newGCPAccessLogHandler(secureHandler, os.Stdout, s.logger)
+		accessLogHandler.redactQueryParams = s.redactQueryParams
+		secureHandler = accessLogHandler
+	}
+
+	if *listenAddr == "" && os.Getenv(portEnvVar) == "" {
+		s.logger.warning("-listenAddr and "+portEnvVar+" not specified; using the default port",
+			logFields{"port": defaultPort})
+	}
+	addr := resolveListenAddr(*listenAddr, os.Getenv(portEnvVar))
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		panic(fmt.Sprintf("invalid -listenAddr=%#v: %s", *listenAddr, err.Error()))
+	}
+	s.logger.info("listening", logFields{"addr": addr, "url": "http://localhost:" + port + "/"})
+	httpServer := newHTTPServer(addr, secureHandler, timeouts)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	// Kubernetes sends SIGTERM to stop pods
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serveErr:
+		panic(err)
+	case sig := <-signals:
+		s.logger.info("shutting down", logFields{"signal": sig.String(),
+			"grace_period": shutdownGracePeriod.String()})
+		err := s.shutdown(httpServer, *shutdownGracePeriod)
+		if err != nil {
+			s.logger.warning("shutdown", logFields{"error": err.Error()})
+		}
+	}
+}
 
-	secureHandler := s.makeSecureHandler(*iapAudience)
+// Timeouts for client connections to the proxy, to protect against slow clients. These are
+// separate from the timeouts for requests to backends.
+type serverTimeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+}
 
-	port := os.Getenv(portEnvVar)
+// The read and write timeouts are disabled by default since they would break long uploads and
+// long streaming responses.
+var defaultServerTimeouts = serverTimeouts{
+	readHeader: 10 * time.Second,
+	read:       0,
+	write:      0,
+	idle:       2 * time.Minute,
+}
+
+// Returns the address to listen on: listenAddr if set, otherwise all interfaces on port, or on
+// defaultPort if port is empty.
+func resolveListenAddr(listenAddr string, port string) string {
+	if listenAddr != "" {
+		return listenAddr
+	}
 	if port == "" {
 		port = defaultPort
-		log.Printf("warning: %s not specified; using default %s", portEnvVar, port)
 	}
+	return ":" + port
+}
 
-	addr := ":" + port
-	log.Printf("listen addr %s (http://localhost:%s/)", addr, port)
-	if err := http.ListenAndServe(addr, secureHandler); err != nil {
-		panic(err)
+func newHTTPServer(addr string, handler http.Handler, timeouts serverTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.readHeader,
+		ReadTimeout:       timeouts.read,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
 	}
 }
 
 type rootTemplateData struct {
-	Namespaces []namespaceTemplateData
+	// -basePath, prepended to links
+	BasePath string
+	// the ?q= filter: only services with namespace/name containing it are listed
+	Query             string
+	Maintenance       bool
+	SkippedNamespaces []string
+	Groups            []groupTemplateData
 }
 
-type namespaceTemplateData struct {
-	Name     string
-	Services []serviceTemplateData
+type groupTemplateData struct {
+	Heading string
+	// true if the group contains services from multiple namespaces
+	ShowNamespace bool
+	Services      []serviceTemplateData
 }
 
 type portTemplateData struct {
 	Name string
 	Port int
+	// path segment linking to the port: its number or name
+	Link string
 }
 
 type serviceTemplateData struct {
+	Namespace string
 	Name      string
 	ClusterIP string
-	TCPPorts  []portTemplateData
+	// e.g. ClusterIP or LoadBalancer
+	Type string
+	// rendered sorted by key: templates range over maps in key order
+	Labels   map[string]string
+	TCPPorts []portTemplateData
+	// if set, the date proxy access to the service ends
+	Sunset string
 }
 
 var rootTemplate = template.Must(template.New("root").Parse(`<!doctype html>
@@ -448,21 +2074,44 @@ var rootTemplate = template.Must(template.New("root").Parse(`<!doctype html>
 <h1>Kube Web Proxy</h1>
 <p>Proxies requests into a Kubernetes cluster.</p>
 <h2>WARNING: This can be a dangerous security hole</h2>
+<form method="get" action="{{.BasePath}}/"><input type="search" name="q" value="{{.Query}}" placeholder="namespace/service">
+<input type="submit" value="Filter">{{if .Query}} <a href="{{.BasePath}}/">Clear</a>{{end}}</form>
+{{if .Maintenance}}<p><strong>Maintenance in progress: proxying is temporarily disabled.</strong></p>{{end}}
+{{if .SkippedNamespaces}}<p>Skipped namespaces without permission to list services:
+{{range $i, $ns := .SkippedNamespaces}}{{if $i}}, {{end}}{{$ns}}{{end}}</p>{{end}}
 
-{{range $namespace := .Namespaces}}
-<h2>Namespace {{$namespace.Name}}</h2>
+{{range $group := .Groups}}
+<h2>{{$group.Heading}}</h2>
 <ul>
-{{range $service := $namespace.Services}}
-<li>{{$service.Name}} 
+{{range $service := $group.Services}}
+<li>{{if $group.ShowNamespace}}{{$service.Namespace}}/{{end}}{{$service.Name}} 
+	{{if $service.Type}}<small>({{$service.Type}})</small>{{end}}
+	{{if $service.Labels}}<small>{{range $key, $value := $service.Labels}}<code>{{$key}}={{$value}}</code> {{end}}</small>{{end}}
+	{{if $service.Sunset}}<strong>deprecated</strong> (access ends {{$service.Sunset}}){{end}}
 	{{if $service.TCPPorts}}
 		<em>TCP Ports</em>: 
 		{{range $port := $service.TCPPorts}}
-			[<a href="/{{$namespace.Name}}/{{$service.Name}}/{{$port.Port}}/">{{$port.Name}} {{$port.Port}}</a>]
+			[<a href="{{$.BasePath}}/{{$service.Namespace}}/{{$service.Name}}/{{$port.Link}}/">{{$port.Name}} {{$port.Port}}</a>]
 		{{end}}
+	{{else}}
+		<em>no web-proxyable ports</em>
 	{{end}}</li>
 {{end}}
 </ul>
-{{end}}
+{{else}}{{if .Query}}
+<p>No services match {{printf "%q" .Query}}.</p>
+{{end}}{{end}}
 
 </body>
 </html>`))
+
+var maintenanceTemplate = template.Must(template.New("maintenance").Parse(`<!doctype html>
+<html>
+<head><title>Kube Web Proxy: Maintenance</title></head>
+<body>
+<h1>Maintenance in progress</h1>
+<p>Proxying is temporarily disabled. Please try again later.</p>
+<p><a href="{{.}}/">Back to the service list</a></p>
+</body>
+</html>
+`))
@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -36,11 +40,60 @@ func (s *staticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type fakeKubernetesAPIClient struct {
-	services corev1.ServiceList
+	services        corev1.ServiceList
+	lastListOptions listOptions
+	listCalls       int
+	// listing services in these namespaces, or all namespaces, returns Forbidden
+	forbiddenNamespaces map[string]bool
 }
 
-func (k *fakeKubernetesAPIClient) list(ctx context.Context, limit int64) (*corev1.ServiceList, error) {
-	return &k.services, nil
+func (k *fakeKubernetesAPIClient) list(ctx context.Context, opts listOptions) (*corev1.ServiceList, error) {
+	k.lastListOptions = opts
+	k.listCalls++
+	if opts.namespace == "" {
+		if len(k.forbiddenNamespaces) > 0 {
+			return nil, errors.NewForbidden(corev1.Resource("services"), "", fmt.Errorf("forbidden"))
+		}
+		if opts.limit == 0 && opts.continueToken == "" {
+			return &k.services, nil
+		}
+	}
+	if k.forbiddenNamespaces[opts.namespace] {
+		return nil, errors.NewForbidden(corev1.Resource("services"), "", fmt.Errorf("forbidden"))
+	}
+	out := &corev1.ServiceList{}
+	for _, s := range k.services.Items {
+		if opts.namespace == "" || s.Namespace == opts.namespace {
+			out.Items = append(out.Items, s)
+		}
+	}
+
+	// continue tokens are the offset of the next item
+	offset := 0
+	if opts.continueToken != "" {
+		var err error
+		offset, err = strconv.Atoi(opts.continueToken)
+		if err != nil || offset > len(out.Items) {
+			return nil, errors.NewResourceExpired("invalid continue token")
+		}
+	}
+	out.Items = out.Items[offset:]
+	if opts.limit > 0 && int64(len(out.Items)) > opts.limit {
+		out.Items = out.Items[:opts.limit]
+		out.Continue = strconv.Itoa(offset + len(out.Items))
+	}
+	return out, nil
+}
+func (k *fakeKubernetesAPIClient) listNamespaces(ctx context.Context) ([]string, error) {
+	var namespaces []string
+	seen := map[string]bool{}
+	for _, s := range k.services.Items {
+		if !seen[s.Namespace] {
+			seen[s.Namespace] = true
+			namespaces = append(namespaces, s.Namespace)
+		}
+	}
+	return namespaces, nil
 }
 func (k *fakeKubernetesAPIClient) get(ctx context.Context, namespace string, name string) (*corev1.Service, error) {
 	for _, s := range k.services.Items {
@@ -51,6 +104,27 @@ func (k *fakeKubernetesAPIClient) get(ctx context.Context, namespace string, nam
 	return nil, errors.NewNotFound(schema.GroupResource{}, name)
 }
 
+// Starts a backend serving handler. Returns a fake API containing namespace/service pointing to
+// it, and the backend's port.
+func newTestBackend(t *testing.T, handler http.Handler) (*fakeKubernetesAPIClient, int) {
+	testServer := httptest.NewServer(handler)
+	t.Cleanup(testServer.Close)
+	port := testServer.Listener.Addr().(*net.TCPAddr).Port
+
+	fakeAPI := &fakeKubernetesAPIClient{}
+	fakeAPI.services.Items = append(fakeAPI.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "localhost",
+			Ports: []corev1.ServicePort{{
+				Protocol: corev1.ProtocolTCP,
+				Port:     int32(port),
+			}},
+		},
+	})
+	return fakeAPI, port
+}
+
 func TestRoot(t *testing.T) {
 	f := &fakeKubernetesAPIClient{}
 	f.services.Items = append(f.services.Items, corev1.Service{
@@ -84,6 +158,251 @@ func TestRoot(t *testing.T) {
 	}
 }
 
+func TestRootHead(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	s := newServer(f)
+
+	r := httptest.NewRequest(http.MethodHead, "/", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Error("expected status OK", recorder.Code)
+	}
+	if recorder.Body.Len() != 0 {
+		t.Errorf("HEAD must not return a body: %#v", recorder.Body.String())
+	}
+	if f.listCalls != 0 {
+		t.Errorf("HEAD should not list services; listCalls=%d", f.listCalls)
+	}
+}
+
+func TestHiddenNamespaces(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	hiddenService := fakeAPI.services.Items[0]
+	hiddenService.ObjectMeta = metav1.ObjectMeta{Namespace: "kube-system", Name: "dashboard"}
+	fakeAPI.services.Items = append(fakeAPI.services.Items, hiddenService)
+	kwp := newServer(fakeAPI)
+	kwp.hiddenNamespaces = map[string]bool{"kube-system": true}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	kwp.rootHandler(recorder, r)
+	if strings.Contains(recorder.Body.String(), "dashboard") {
+		t.Errorf("root page must not list the hidden namespace:\n%s", recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Body.String(), fmt.Sprintf(`href="/namespace/service/%d/"`, port)) {
+		t.Errorf("root page should list other namespaces:\n%s", recorder.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/kube-system/dashboard/%d/", port), nil)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("hidden service should be proxied: status=%d body=%s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestRequireAnnotation(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	fakeAPI.services.Items[0].Annotations = map[string]string{exposeAnnotation: "true"}
+	for _, name := range []string{"unannotated", "disabled"} {
+		service := *fakeAPI.services.Items[0].DeepCopy()
+		service.Name = name
+		service.Annotations = nil
+		if name == "disabled" {
+			service.Annotations = map[string]string{exposeAnnotation: "false"}
+		}
+		fakeAPI.services.Items = append(fakeAPI.services.Items, service)
+	}
+	kwp := newServer(fakeAPI)
+	kwp.requireAnnotation = true
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	kwp.rootHandler(recorder, r)
+	if !strings.Contains(recorder.Body.String(), fmt.Sprintf(`href="/namespace/service/%d/"`, port)) {
+		t.Errorf("root page should list the annotated service:\n%s", recorder.Body.String())
+	}
+	for _, name := range []string{"unannotated", "disabled"} {
+		if strings.Contains(recorder.Body.String(), name) {
+			t.Errorf("root page must not list %s:\n%s", name, recorder.Body.String())
+		}
+	}
+
+	for name, expected := range map[string]int{
+		"service":     http.StatusOK,
+		"unannotated": http.StatusNotFound,
+		"disabled":    http.StatusNotFound,
+	} {
+		r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/%s/%d/", name, port), nil)
+		recorder = httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Code != expected {
+			t.Errorf("%s: status=%d; expected %d", name, recorder.Code, expected)
+		}
+	}
+}
+
+func TestNoTCPPorts(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	for _, name := range []string{"udp-only", "no-ports"} {
+		service := corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: name}}
+		if name == "udp-only" {
+			service.Spec.Ports = []corev1.ServicePort{{Protocol: corev1.ProtocolUDP, Port: 53}}
+		}
+		f.services.Items = append(f.services.Items, service)
+	}
+	s := newServer(f)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	if count := strings.Count(recorder.Body.String(), "no web-proxyable ports"); count != 2 {
+		t.Errorf("expected 2 services with no web-proxyable ports; found %d", count)
+		t.Error(recorder.Body.String())
+	}
+
+	for _, name := range []string{"udp-only", "no-ports"} {
+		r = httptest.NewRequest(http.MethodGet, "/namespace/"+name+"/80/", nil)
+		recorder = httptest.NewRecorder()
+		s.proxyErrWrapper(recorder, r)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status BadRequest; got %d", name, recorder.Code)
+		}
+		expected := "service namespace/" + name + " exposes no TCP ports"
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("%s: output should contain %#v: %s", name, expected, recorder.Body.String())
+		}
+	}
+}
+
+func TestRootForbiddenNamespace(t *testing.T) {
+	f := &fakeKubernetesAPIClient{forbiddenNamespaces: map[string]bool{"secret": true}}
+	for _, namespace := range []string{"visible", "secret"} {
+		f.services.Items = append(f.services.Items, corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: namespace + "-service"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+			},
+		})
+	}
+	s := newServer(f)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Fatal("expected status OK", recorder.Code, recorder.Body.String())
+	}
+	body := recorder.Body.String()
+	if !strings.Contains(body, `href="/visible/visible-service/80/"`) {
+		t.Error("should have found link to visible service", body)
+	}
+	if strings.Contains(body, "secret-service") {
+		t.Error("must not list the forbidden namespace's services", body)
+	}
+	if !strings.Contains(body, "Skipped namespaces without permission to list services:\nsecret") {
+		t.Error("should report the skipped namespace", body)
+	}
+}
+
+func TestRootSortByName(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	for _, ns := range [][2]string{{"a", "zebra"}, {"b", "apple"}, {"a", "mango"}} {
+		f.services.Items = append(f.services.Items, corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns[0], Name: ns[1]},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+			},
+		})
+	}
+	s := newServer(f)
+	s.sortBy = sortByName
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	body := recorder.Body.String()
+	if strings.Count(body, "<h2>") != 2 || !strings.Contains(body, "All Namespaces") {
+		t.Error("expected a single group of services", body)
+	}
+	apple := strings.Index(body, `href="/b/apple/80/"`)
+	mango := strings.Index(body, `href="/a/mango/80/"`)
+	zebra := strings.Index(body, `href="/a/zebra/80/"`)
+	if apple < 0 || mango < 0 || zebra < 0 || !(apple < mango && mango < zebra) {
+		t.Error("services must be sorted by name across namespaces", body)
+	}
+}
+
+func TestRootGroupByLabel(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	for _, service := range []struct{ namespace, name, team string }{
+		{"ns1", "frontend", "web"},
+		{"ns2", "orphan", ""},
+		{"ns2", "api", "web"},
+		{"ns1", "db", "data"},
+	} {
+		labels := map[string]string{}
+		if service.team != "" {
+			labels["team"] = service.team
+		}
+		f.services.Items = append(f.services.Items, corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: service.namespace, Name: service.name, Labels: labels},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+			},
+		})
+	}
+	s := newServer(f)
+	s.groupByLabel = "team"
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	body := recorder.Body.String()
+
+	// groups are sorted by label value, with unlabeled last
+	order := []string{
+		"<h2>team: data</h2>", `href="/ns1/db/80/"`,
+		"<h2>team: web</h2>", `href="/ns1/frontend/80/"`, `href="/ns2/api/80/"`,
+		"<h2>unlabeled</h2>", `href="/ns2/orphan/80/"`,
+	}
+	last := -1
+	for _, s := range order {
+		index := strings.Index(body, s)
+		if index <= last {
+			t.Fatalf("%#v missing or out of order:\n%s", s, body)
+		}
+		last = index
+	}
+}
+
+func TestRootListOptions(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	s := newServer(f)
+	s.listOptions.fieldSelector = "metadata.namespace!=kube-system"
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Error("expected status OK", recorder.Code)
+	}
+	if f.lastListOptions.fieldSelector != s.listOptions.fieldSelector {
+		t.Errorf("list fieldSelector=%#v; expected %#v",
+			f.lastListOptions.fieldSelector, s.listOptions.fieldSelector)
+	}
+
+	err := s.checkPermissions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.lastListOptions.limit != 1 || f.lastListOptions.fieldSelector != s.listOptions.fieldSelector {
+		t.Errorf("checkPermissions list options=%#v", f.lastListOptions)
+	}
+}
+
 func TestProxy(t *testing.T) {
 	static := &staticServer{}
 	testServer := httptest.NewServer(static)
@@ -120,6 +439,34 @@ func TestProxy(t *testing.T) {
 		t.Error("expected status NotFound", recorder.Code, recorder.Body.String())
 	}
 
+	// a service that was re-created with different ports
+	r = httptest.NewRequest(http.MethodGet, "/namespace/service/1/", nil)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusNotFound {
+		t.Error("expected status NotFound", recorder.Code, recorder.Body.String())
+	}
+	expected := fmt.Sprintf("port 1 was not found; it may have changed since the service list was loaded; available TCP ports: %d",
+		testServerAddr.Port)
+	if !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("output should contain %#v", expected)
+		t.Error(recorder.Body.String())
+	}
+
+	// a port that exists only as UDP
+	fakeAPI.services.Items[0].Spec.Ports[0].Port = 53
+	r = httptest.NewRequest(http.MethodGet, "/namespace/service/53/", nil)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("expected status BadRequest", recorder.Code, recorder.Body.String())
+	}
+	expected = "port 53 exists only as UDP and cannot be web proxied"
+	if !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("output should contain %#v", expected)
+		t.Error(recorder.Body.String())
+	}
+
 	goodRoot := fmt.Sprintf("/namespace/service/%d/", testServerAddr.Port)
 	r = httptest.NewRequest(http.MethodGet, goodRoot+"subdir/", nil)
 	recorder = httptest.NewRecorder()
@@ -127,7 +474,7 @@ func TestProxy(t *testing.T) {
 	if recorder.Code != http.StatusResetContent {
 		t.Error("expected status ResetContent (205)", recorder.Code, recorder.Body.String())
 	}
-	expected := fmt.Sprintf(`"%srootrelative"`, goodRoot)
+	expected = fmt.Sprintf(`"%srootrelative"`, goodRoot)
 	if !strings.Contains(recorder.Body.String(), expected) {
 		t.Errorf("output should contain %#v", expected)
 		t.Error(recorder.Body.String())
@@ -164,113 +511,1382 @@ func TestProxy(t *testing.T) {
 	}
 }
 
-func TestPathRegexp(t *testing.T) {
-	matches := servicePattern.FindStringSubmatch("/namespace/service/123/")
-	if len(matches) != 5 {
-		t.Error(matches)
+func TestMaintenance(t *testing.T) {
+	kwp := newServer(&fakeKubernetesAPIClient{})
+	kwp.maintenance.Store(true)
+	handler := kwp.makeSecureHandler("noaudience")
+
+	r := httptest.NewRequest(http.MethodGet, "/namespace/service/123/", nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Error("expected status ServiceUnavailable", recorder.Code)
 	}
-	if !(matches[1] == "namespace" && matches[2] == "service" && matches[3] == "123" && matches[4] == "/") {
-		t.Error(matches)
+	if !strings.Contains(recorder.Body.String(), "Maintenance in progress") {
+		t.Error("expected maintenance message", recorder.Body.String())
 	}
-}
 
-func TestRewriteURL(t *testing.T) {
-	const rootPath = "/extra/path"
-	type testData struct {
-		input    string
-		expected string
-	}
-	tests := []testData{
-		{"https://www.example.com/path", "https://www.example.com/path"},
-		{"/root", "/extra/path/root"},
-		{"/root/", "/extra/path/root/"},
-		{"./dir/relative", "./dir/relative"},
-		{"./dir/relative/", "./dir/relative/"},
-		{"relative.txt", "relative.txt"},
-		{"#anchor", "#anchor"},
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder = httptest.NewRecorder()
+	kwp.rootHandler(recorder, r)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "Maintenance in progress") {
+		t.Error("root should render with maintenance notice", recorder.Code, recorder.Body.String())
 	}
-	for i, test := range tests {
-		output := rewriteURL(test.input, rootPath)
-		if output != test.expected {
-			t.Errorf("%d: rewriteURL(%#v, %#v)=%#v; expected %#v",
-				i, test.input, rootPath, output, test.expected)
-		}
+
+	r = httptest.NewRequest(http.MethodGet, "/health", nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Error("health check should return 200 OK in maintenance", recorder.Code)
 	}
-}
 
-func TestRewriteHTML(t *testing.T) {
-	out := &bytes.Buffer{}
-	err := rewriteAbsolutePathLinks(out, strings.NewReader(exampleHTML), "/extra/path")
-	if err != nil {
-		t.Fatal(err)
+	email := "user@example.com"
+	kwp.userEmail = func(*http.Request) string { return email }
+	kwp.maintenanceAdmins = map[string]bool{"admin@example.com": true}
+	post := func(contentType string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/admin/maintenance", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		kwp.maintenanceHandler(recorder, r)
+		return recorder
 	}
 
-	mustContain := []string{
-		`"https://www.example.com/absolute"`,
-		`"/extra/path/rootrelative"`,
-		`"./dir/relative1"`,
-		`"/extra/path/root/post"`,
-		// Checks for https://github.com/golang/go/issues/7929
-		`"use strict";`,
+	recorder = post("application/json", `{"enabled": false}`)
+	if recorder.Code != http.StatusForbidden || !kwp.maintenance.Load() {
+		t.Error("only admins may change maintenance mode", recorder.Code, recorder.Body.String())
 	}
-	for i, s := range mustContain {
-		if !strings.Contains(out.String(), s) {
-			t.Errorf("%d: output must contain %#v\n%s", i, s, out.String())
-		}
+	email = "admin@example.com"
+	// a cross-site form cannot change it
+	recorder = post("application/x-www-form-urlencoded", "enabled=false")
+	if recorder.Code != http.StatusUnsupportedMediaType || !kwp.maintenance.Load() {
+		t.Error("form posts must be rejected", recorder.Code, recorder.Body.String())
+	}
+	recorder = post("application/json", `{}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("enabled is required", recorder.Code, recorder.Body.String())
+	}
+	recorder = post("application/json; charset=utf-8", `{"enabled": false}`)
+	if recorder.Code != http.StatusOK || kwp.maintenance.Load() {
+		t.Error("maintenance should be disabled", recorder.Code, recorder.Body.String())
 	}
 }
 
-func TestHealth(t *testing.T) {
-	fakeAPI := &fakeKubernetesAPIClient{}
+func TestProxyNamedPort(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/login")
+		w.Header().Set("Echo-Path", r.URL.Path)
+	}))
+	fakeAPI.services.Items[0].Spec.Ports[0].Name = "http"
 	kwp := newServer(fakeAPI)
-	handler := kwp.makeSecureHandler("noaudience")
 
-	req := httptest.NewRequest(http.MethodGet, "/health", nil)
-	resp := httptest.NewRecorder()
-	handler.ServeHTTP(resp, req)
-	if resp.Code != http.StatusOK {
-		t.Error("health check should return 200 OK", resp.Code)
+	for _, portSegment := range []string{strconv.Itoa(port), "http"} {
+		r := httptest.NewRequest(http.MethodGet, "/namespace/service/"+portSegment+"/page", nil)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Header().Get("Echo-Path") != "/page" {
+			t.Errorf("%s: status=%d backend path=%#v", portSegment, recorder.Code, recorder.Header().Get("Echo-Path"))
+		}
+		// links are rewritten relative to the port as requested
+		expected := "/namespace/service/" + portSegment + "/login"
+		if recorder.Header().Get("Location") != expected {
+			t.Errorf("%s: Location=%#v; expected %#v", portSegment, recorder.Header().Get("Location"), expected)
+		}
 	}
-}
 
-func TestIsRootHealthCheck(t *testing.T) {
-	type testCase struct {
-		userAgent string
-		path      string
-		expected  bool
+	r := httptest.NewRequest(http.MethodGet, "/namespace/service/metrics/", nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown port name: status=%d; expected NotFound", recorder.Code)
 	}
-	testCases := []testCase{
-		{"kube-probe/1.13+", "/", true},
-		{"kube-probe/1.17", "/", true},
-		{"GoogleHC/1.0", "/", true},
-		{"xGoogleHC/2.1", "/", true},
-
-		{"GoogleHCx/2.1", "/", false},
-		// real chrome
-		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/79.0.3945.117 Safari/537.36",
-			"/", false},
-		{"GoogleHC/1.0", "/other", false},
+	expected := "service namespace/service has no TCP port named metrics; available named TCP ports: http"
+	if !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("output should contain %#v: %s", expected, recorder.Body.String())
 	}
-	for i, test := range testCases {
-		r := httptest.NewRequest(http.MethodGet, test.path, nil)
-		r.Header.Set("User-Agent", test.userAgent)
-		result := isRootHealthCheck(r)
-		if result != test.expected {
-			t.Errorf("%d: isRootHealthCheck(User-Agent:%s Path:%s)=%t; expected %t",
-				i, test.userAgent, test.path, result, test.expected)
-		}
+
+	kwp.linkPortNames = true
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder = httptest.NewRecorder()
+	kwp.rootHandler(recorder, r)
+	if !strings.Contains(recorder.Body.String(), `href="/namespace/service/http/"`) {
+		t.Errorf("root page should link to the port by name:\n%s", recorder.Body.String())
 	}
 }
 
-const exampleHTML = `<html><body>
-<a href="./dir/relative1">relative1</a>
-<a href="/rootrelative">rootrelative</a>
-<a href="https://www.example.com/absolute">absolute</a>
-<form method="post" action="/root/post">
-<script>
+func TestProxyByUID(t *testing.T) {
+	testServer := httptest.NewServer(&staticServer{})
+	defer testServer.Close()
+	testServerAddr := testServer.Listener.Addr().(*net.TCPAddr)
+
+	fakeAPI := &fakeKubernetesAPIClient{}
+	fakeAPI.services.Items = append(fakeAPI.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "namespace",
+			Name:      "service",
+			UID:       "1234-abcd",
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "localhost",
+			Ports: []corev1.ServicePort{{
+				Protocol: corev1.ProtocolTCP,
+				Port:     int32(testServerAddr.Port),
+			}},
+		},
+	})
+	kwp := newServer(fakeAPI)
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/_uid/notfound/%d/", testServerAddr.Port), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusNotFound {
+		t.Error("expected status NotFound", recorder.Code, recorder.Body.String())
+	}
+
+	goodRoot := fmt.Sprintf("/_uid/1234-abcd/%d/", testServerAddr.Port)
+	r = httptest.NewRequest(http.MethodGet, goodRoot, nil)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusResetContent {
+		t.Error("expected status ResetContent (205)", recorder.Code, recorder.Body.String())
+	}
+	expected := fmt.Sprintf(`"%srootrelative"`, goodRoot)
+	if !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("output should contain %#v", expected)
+		t.Error(recorder.Body.String())
+	}
+}
+
+func TestProxyNamespacesNamedLikeRoutes(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, &staticServer{})
+	kwp := newServer(fakeAPI)
+	kwp.pods = &fakePodClient{}
+	for _, namespace := range []string{"uid", "pods"} {
+		fakeAPI.services.Items[0].Namespace = namespace
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%s/service/%d/", namespace, port), nil)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Code != http.StatusResetContent {
+			t.Errorf("namespace %s: status=%d; expected the service to be proxied", namespace, recorder.Code)
+		}
+	}
+}
+
+func TestResolveTimeout(t *testing.T) {
+	kwp := newServer(&fakeKubernetesAPIClient{})
+	kwp.backendTimeout = 30 * time.Second
+
+	annotated := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{timeoutAnnotation: "60s"},
+	}}
+	invalid := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{timeoutAnnotation: "forever"},
+	}}
+	type testCase struct {
+		service  *corev1.Service
+		accept   string
+		expected time.Duration
+	}
+	testCases := []testCase{
+		{&corev1.Service{}, "", 30 * time.Second},
+		{annotated, "", 60 * time.Second},
+		{invalid, "", 30 * time.Second},
+		{annotated, "text/event-stream", 0},
+		{&corev1.Service{}, "text/event-stream", 0},
+	}
+	for i, test := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/namespace/service/80/", nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		timeout := kwp.resolveTimeout(r, test.service)
+		if timeout != test.expected {
+			t.Errorf("%d: resolveTimeout(Accept:%s annotations:%v)=%s; expected %s",
+				i, test.accept, test.service.Annotations, timeout, test.expected)
+		}
+	}
+}
+
+func TestProxyCollapsesSlashes(t *testing.T) {
+	// echo the path in a response header
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend-Path", r.URL.Path)
+	}))
+	kwp := newServer(fakeAPI)
+
+	type testCase struct {
+		destPath string
+		expected string
+	}
+	testCases := []testCase{
+		{"/", "/"},
+		{"//", "/"},
+		{"//dir///file", "/dir/file"},
+		{"/dir//", "/dir/"},
+	}
+	for i, test := range testCases {
+		r := httptest.NewRequest(http.MethodGet,
+			fmt.Sprintf("/namespace/service/%d%s", port, test.destPath), nil)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%d: expected status OK: %d %s", i, recorder.Code, recorder.Body.String())
+		}
+		backendPath := recorder.Header().Get("X-Backend-Path")
+		if backendPath != test.expected {
+			t.Errorf("%d: destPath %#v was forwarded as %#v; expected %#v",
+				i, test.destPath, backendPath, test.expected)
+		}
+	}
+}
+
+func TestProxyOriginalURLHeader(t *testing.T) {
+	// echo the header in the response
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(originalURLHeader, r.Header.Get(originalURLHeader))
+	}))
+	kwp := newServer(fakeAPI)
+
+	path := fmt.Sprintf("/namespace/service/%d/dir/page?k=v", port)
+	r := httptest.NewRequest(http.MethodGet, "http://kwp.example.com"+path, nil)
+	// from a Google Cloud load balancer, which is trusted by default
+	r.RemoteAddr = "130.211.0.5:1234"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	expected := "https://kwp.example.com" + path
+	if recorder.Header().Get(originalURLHeader) != expected {
+		t.Errorf("%s=%#v; expected %#v",
+			originalURLHeader, recorder.Header().Get(originalURLHeader), expected)
+	}
+}
+
+func TestProxyForwardHeaders(t *testing.T) {
+	// echo the received headers in the response
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range r.Header {
+			w.Header()["Echo-"+name] = values
+		}
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.forwardHeaders = map[string]bool{"X-Allowed": true}
+
+	r := httptest.NewRequest(http.MethodPost,
+		fmt.Sprintf("/namespace/service/%d/", port), strings.NewReader("k=v"))
+	r.Header.Set("X-Allowed", "allowed")
+	r.Header.Set("X-Secret", "secret")
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+
+	if recorder.Header().Get("Echo-X-Allowed") != "allowed" {
+		t.Error("allowed header must be forwarded", recorder.Header())
+	}
+	if recorder.Header().Get("Echo-Content-Type") == "" {
+		t.Error("essential header Content-Type must be forwarded", recorder.Header())
+	}
+	for _, name := range []string{"X-Secret", "Cookie"} {
+		if recorder.Header().Get("Echo-"+name) != "" {
+			t.Errorf("header %s must not be forwarded: %v", name, recorder.Header())
+		}
+	}
+}
+
+func TestProxyConnectionHeader(t *testing.T) {
+	// echo the received headers in the response
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range r.Header {
+			w.Header()["Echo-"+name] = values
+		}
+	}))
+	kwp := newServer(fakeAPI)
+
+	type testCase struct {
+		connection     string
+		upgrade        string
+		forwardHeaders map[string]bool
+		expectedConn   string
+	}
+	testCases := []testCase{
+		// hop-by-hop headers listed in Connection are removed, with Connection itself
+		{"close, X-Hop", "", nil, ""},
+		{"keep-alive, x-hop", "", map[string]bool{"X-Hop": true, "X-End": true}, ""},
+		// upgrades keep only Connection: Upgrade and the Upgrade header
+		{"keep-alive, Upgrade, X-Hop", "websocket", nil, "Upgrade"},
+		{"Upgrade, X-Hop", "websocket", map[string]bool{"X-Hop": true, "X-End": true}, "Upgrade"},
+	}
+	for i, test := range testCases {
+		kwp.forwardHeaders = test.forwardHeaders
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+		r.Header.Set("Connection", test.connection)
+		if test.upgrade != "" {
+			r.Header.Set("Upgrade", test.upgrade)
+		}
+		r.Header.Set("X-Hop", "hop")
+		r.Header.Set("Keep-Alive", "timeout=5")
+		r.Header.Set("X-End", "end")
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+
+		echoed := recorder.Header()
+		if echoed.Get("Echo-Connection") != test.expectedConn {
+			t.Errorf("%d: Connection=%#v; expected %#v", i, echoed.Get("Echo-Connection"), test.expectedConn)
+		}
+		if echoed.Get("Echo-Upgrade") != test.upgrade {
+			t.Errorf("%d: Upgrade=%#v; expected %#v", i, echoed.Get("Echo-Upgrade"), test.upgrade)
+		}
+		for _, name := range []string{"X-Hop", "Keep-Alive"} {
+			if echoed.Get("Echo-"+name) != "" {
+				t.Errorf("%d: hop-by-hop header %s must not be forwarded", i, name)
+			}
+		}
+		if echoed.Get("Echo-X-End") != "end" {
+			t.Errorf("%d: end-to-end header X-End must be forwarded", i)
+		}
+	}
+}
+
+func TestProxyForceContentType(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(exampleHTML))
+	}))
+	fakeAPI.services.Items[0].Annotations = map[string]string{
+		forceContentTypeAnnotation: "text/html; charset=utf-8",
+	}
+	kwp := newServer(fakeAPI)
+
+	goodRoot := fmt.Sprintf("/namespace/service/%d/", port)
+	r := httptest.NewRequest(http.MethodGet, goodRoot, nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type=%#v; expected forced type", recorder.Header().Get("Content-Type"))
+	}
+	expected := fmt.Sprintf(`"%srootrelative"`, goodRoot)
+	if !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("output should contain %#v", expected)
+		t.Error(recorder.Body.String())
+	}
+}
+
+func TestProxyRewriteStatusCodes(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(exampleHTML))
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.rewriteStatusCodes = map[int]bool{http.StatusOK: true}
+
+	root := fmt.Sprintf("/namespace/service/%d/", port)
+	rewritten := fmt.Sprintf(`"%srootrelative"`, root)
+	for _, test := range []struct {
+		path            string
+		expectedCode    int
+		expectRewritten bool
+	}{
+		{"ok", http.StatusOK, true},
+		{"missing", http.StatusNotFound, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, root+test.path, nil)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Code != test.expectedCode {
+			t.Errorf("%s: status=%d; expected %d", test.path, recorder.Code, test.expectedCode)
+		}
+		if strings.Contains(recorder.Body.String(), rewritten) != test.expectRewritten {
+			t.Errorf("%s: expected rewritten=%t:\n%s", test.path, test.expectRewritten, recorder.Body.String())
+		}
+		if !test.expectRewritten && recorder.Body.String() != exampleHTML {
+			t.Errorf("%s: body should be unmodified:\n%s", test.path, recorder.Body.String())
+		}
+	}
+}
+
+func TestProxyNoTransform(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "public, No-Transform")
+		w.Write([]byte(exampleHTML))
+	}))
+	kwp := newServer(fakeAPI)
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Body.String() != exampleHTML {
+		t.Errorf("no-transform body must not be modified:\n%s", recorder.Body.String())
+	}
+	if recorder.Header().Get("Content-Length") != strconv.Itoa(len(exampleHTML)) {
+		t.Errorf("Content-Length=%#v; expected it to be preserved", recorder.Header().Get("Content-Length"))
+	}
+}
+
+func TestProxyPreservesContentTypeParams(t *testing.T) {
+	const multipartType = `multipart/mixed; boundary="simple boundary"; charset=utf-8`
+	const body = "--simple boundary\r\nContent-Type: text/html\r\n\r\n<a href=\"/x\">x</a>\r\n--simple boundary--\r\n"
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", multipartType)
+		w.Write([]byte(body))
+	}))
+	kwp := newServer(fakeAPI)
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Header().Get("Content-Type") != multipartType {
+		t.Errorf("Content-Type=%#v; expected %#v", recorder.Header().Get("Content-Type"), multipartType)
+	}
+	if recorder.Body.String() != body {
+		t.Errorf("multipart body must not be rewritten: %#v", recorder.Body.String())
+	}
+}
+
+func TestProxyLinkHints(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, &staticServer{})
+	kwp := newServer(fakeAPI)
+	kwp.linkHints = splitLinkValues(`</>; rel=prefetch, </static/a,b.css>; rel=preload; as=style`)
+	if len(kwp.linkHints) != 2 {
+		t.Fatalf("splitLinkValues returned %#v", kwp.linkHints)
+	}
+
+	goodRoot := fmt.Sprintf("/namespace/service/%d", port)
+	r := httptest.NewRequest(http.MethodGet, goodRoot+"/", nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	links := recorder.Header().Values("Link")
+	expected := []string{
+		"<" + goodRoot + "/>; rel=prefetch",
+		"<" + goodRoot + "/static/a,b.css>; rel=preload; as=style",
+	}
+	if len(links) != len(expected) {
+		t.Fatalf("Link=%#v; expected %#v", links, expected)
+	}
+	for i := range expected {
+		if links[i] != expected[i] {
+			t.Errorf("Link[%d]=%#v; expected %#v", i, links[i], expected[i])
+		}
+	}
+}
+
+func TestProxySlowRequestLog(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.slowRequestThreshold = time.Millisecond
+
+	logOutput := &bytes.Buffer{}
+	log.SetOutput(logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	path := fmt.Sprintf("/namespace/service/%d/slow", port)
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	expected := "warning: slow request duration_ms="
+	if !strings.Contains(logOutput.String(), expected) {
+		t.Errorf("log should contain %#v:\n%s", expected, logOutput.String())
+	}
+	expected = " method=GET path=" + path + " threshold_ms=1\n"
+	if !strings.Contains(logOutput.String(), expected) {
+		t.Errorf("log should contain %#v:\n%s", expected, logOutput.String())
+	}
+}
+
+func TestProxyAppendUserAgent(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Echo-User-Agent", r.UserAgent())
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.appendUserAgent = true
+
+	for _, clientAgent := range []string{"TestBrowser/1.0", ""} {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+		r.Header.Set("User-Agent", clientAgent)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+
+		expected := "kubewebproxy/" + proxyVersion()
+		if clientAgent != "" {
+			expected = clientAgent + " " + expected
+		}
+		if recorder.Header().Get("Echo-User-Agent") != expected {
+			t.Errorf("backend User-Agent=%#v; expected %#v",
+				recorder.Header().Get("Echo-User-Agent"), expected)
+		}
+	}
+}
+
+func TestProxyRedactQueryParams(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Echo-Query", r.URL.RawQuery)
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.redactQueryParams = map[string]bool{"token": true}
+
+	logOutput := &bytes.Buffer{}
+	log.SetOutput(logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	query := "a=1&token=secret123&b=2"
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/?%s", port, query), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	// the backend must still get the real value
+	if recorder.Header().Get("Echo-Query") != query {
+		t.Errorf("backend query=%#v; expected %#v", recorder.Header().Get("Echo-Query"), query)
+	}
+	if strings.Contains(logOutput.String(), "secret123") {
+		t.Errorf("log must not contain the secret:\n%s", logOutput.String())
+	}
+	if !strings.Contains(logOutput.String(), "?a=1&token=REDACTED&b=2") {
+		t.Errorf("log should contain the redacted query:\n%s", logOutput.String())
+	}
+}
+
+func TestProxyStreamsRequestBody(t *testing.T) {
+	const chunkSize = 64 * 1024
+	const chunks = 16
+	firstChunkReceived := make(chan struct{})
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, chunkSize/2)
+		n, err := io.ReadFull(r.Body, buf)
+		if err != nil {
+			panic(err)
+		}
+		close(firstChunkReceived)
+		rest, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Echo-Length", strconv.FormatInt(int64(n)+rest, 10))
+	}))
+	kwp := newServer(fakeAPI)
+
+	// the backend must receive the first chunk before the rest of the body is written
+	bodyReader, bodyWriter := io.Pipe()
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), chunkSize)
+		bodyWriter.Write(chunk)
+		select {
+		case <-firstChunkReceived:
+		case <-time.After(5 * time.Second):
+			bodyWriter.CloseWithError(fmt.Errorf("backend did not receive the first chunk: body was buffered"))
+			return
+		}
+		for i := 1; i < chunks; i++ {
+			bodyWriter.Write(chunk)
+		}
+		bodyWriter.Close()
+	}()
+
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/namespace/service/%d/upload", port), bodyReader)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", recorder.Code, recorder.Body.String())
+	}
+	expected := strconv.Itoa(chunkSize * chunks)
+	if recorder.Header().Get("Echo-Length") != expected {
+		t.Errorf("backend received %#v bytes; expected %s", recorder.Header().Get("Echo-Length"), expected)
+	}
+}
+
+func TestPathRegexp(t *testing.T) {
+	matches := servicePattern.FindStringSubmatch("/namespace/service/123/")
+	if len(matches) != 5 {
+		t.Error(matches)
+	}
+	if !(matches[1] == "namespace" && matches[2] == "service" && matches[3] == "123" && matches[4] == "/") {
+		t.Error(matches)
+	}
+}
+
+func TestRewriteURL(t *testing.T) {
+	const rootPath = "/extra/path"
+	type testData struct {
+		input    string
+		expected string
+	}
+	tests := []testData{
+		{"https://www.example.com/path", "https://www.example.com/path"},
+		{"/root", "/extra/path/root"},
+		{"/root/", "/extra/path/root/"},
+		{"./dir/relative", "./dir/relative"},
+		{"./dir/relative/", "./dir/relative/"},
+		{"relative.txt", "relative.txt"},
+		{"#anchor", "#anchor"},
+
+		{"//cdn.example.com/script.js", "//cdn.example.com/script.js"},
+		{"/a//b//", "/extra/path/a/b/"},
+
+		// directory-style paths stay directories; files stay files
+		{"/", "/extra/path/"},
+		{"/dir", "/extra/path/dir"},
+		{"/dir/", "/extra/path/dir/"},
+		{"/dir/index.html", "/extra/path/dir/index.html"},
+		{"/dir/index.html?k=v#top", "/extra/path/dir/index.html?k=v#top"},
+		{"/dir/?k=v", "/extra/path/dir/?k=v"},
+		{"/dir/.", "/extra/path/dir/"},
+		{"/dir/sub/..", "/extra/path/dir/"},
+		{"/dir/./index.html", "/extra/path/dir/index.html"},
+
+		// .. must not escape the prefix
+		{"/..", "/extra/path/"},
+		{"/../../etc/passwd", "/extra/path/etc/passwd"},
+		{"/extra/path/../../other", "/extra/path/other"},
+
+		// already prefixed (e.g. Location from a backend using X-Forwarded-Prefix): unchanged
+		{"/extra/path/root", "/extra/path/root"},
+		{"/extra/path", "/extra/path"},
+		{"/extra/path/", "/extra/path/"},
+		{"/extra/pathology", "/extra/path/extra/pathology"},
+
+		// special schemes must be left untouched
+		{"mailto:user@example.com", "mailto:user@example.com"},
+		{"MAILTO:/user@example.com", "MAILTO:/user@example.com"},
+		{"tel:+123", "tel:+123"},
+		{"javascript:void(0)", "javascript:void(0)"},
+		{"javascript:alert('100%')", "javascript:alert('100%')"},
+		{"data:text/plain;base64,SGVsbG8=", "data:text/plain;base64,SGVsbG8="},
+		{"blob:https://example.com/uuid", "blob:https://example.com/uuid"},
+	}
+	for i, test := range tests {
+		output := rewriteURL(test.input, rootPath)
+		if output != test.expected {
+			t.Errorf("%d: rewriteURL(%#v, %#v)=%#v; expected %#v",
+				i, test.input, rootPath, output, test.expected)
+		}
+	}
+}
+
+func TestRewriteURLQueryFragment(t *testing.T) {
+	const rootPath = "/ns/svc/80"
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"/search?q=1", "/ns/svc/80/search?q=1"},
+		{"/page#section", "/ns/svc/80/page#section"},
+		{"/search?q=foo#top", "/ns/svc/80/search?q=foo#top"},
+		{"/dir/?a=b&c=d", "/ns/svc/80/dir/?a=b&c=d"},
+		{"/?q=1", "/ns/svc/80/?q=1"},
+		{"/search?", "/ns/svc/80/search?"},
+		{"/page#", "/ns/svc/80/page#"},
+		// copied exactly, without re-encoding
+		{"/search?q=a+b%20c&x=%2F#frag%20ment", "/ns/svc/80/search?q=a+b%20c&x=%2F#frag%20ment"},
+		{"/page#/route?x=1", "/ns/svc/80/page#/route?x=1"},
+		{"/a%2Fb/c?q=1", "/ns/svc/80/a%2Fb/c?q=1"},
+		// no path: relative to the current page, so unchanged
+		{"?q=1", "?q=1"},
+		{"?q=1#top", "?q=1#top"},
+		{"#top", "#top"},
+	}
+	for i, test := range tests {
+		output := rewriteURL(test.input, rootPath)
+		if output != test.expected {
+			t.Errorf("%d: rewriteURL(%#v, %#v)=%#v; expected %#v",
+				i, test.input, rootPath, output, test.expected)
+		}
+	}
+}
+
+func TestStripProxyHost(t *testing.T) {
+	proxyHosts := map[string]bool{"proxy.example.com": true, "localhost:8080": true}
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"https://proxy.example.com/login?next=/x#top", "/login?next=/x#top"},
+		{"http://PROXY.example.com:443/page", "/page"},
+		{"//proxy.example.com", "/"},
+		{"http://localhost:8080/a", "/a"},
+		{"http://localhost:9090/a", "http://localhost:9090/a"},
+		{"https://other.example.com/page", "https://other.example.com/page"},
+		{"ftp://proxy.example.com/file", "ftp://proxy.example.com/file"},
+		{"/path", "/path"},
+	}
+	for i, test := range tests {
+		output := stripProxyHost(test.input, proxyHosts)
+		if output != test.expected {
+			t.Errorf("%d: stripProxyHost(%#v)=%#v; expected %#v", i, test.input, output, test.expected)
+		}
+	}
+}
+
+func TestProxyHosts(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "https://proxy.example.com/login?next=1", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="https://proxy.example.com/page">own</a><a href="https://other.example.com/page">other</a>`))
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.rewriteOptions.proxyHosts = map[string]bool{"proxy.example.com": true}
+	root := fmt.Sprintf("/namespace/service/%d", port)
+
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, httptest.NewRequest(http.MethodGet, root+"/redirect", nil))
+	if recorder.Header().Get("Location") != root+"/login?next=1" {
+		t.Errorf("Location=%#v; expected %#v", recorder.Header().Get("Location"), root+"/login?next=1")
+	}
+
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, httptest.NewRequest(http.MethodGet, root+"/", nil))
+	expected := `<a href="` + root + `/page">own</a><a href="https://other.example.com/page">other</a>`
+	if recorder.Body.String() != expected {
+		t.Errorf("body=%#v; expected %#v", recorder.Body.String(), expected)
+	}
+}
+
+func TestRewriteURLFrom(t *testing.T) {
+	const rootPath = "/ns/svc/80"
+	tests := []struct {
+		input    string
+		destPath string
+		expected string
+	}{
+		// relative links that stay under the root are unchanged
+		{"../sibling", "/a/b/page", "../sibling"},
+		{"../sibling", "/a/page", "../sibling"},
+		{"./child", "/a/page", "./child"},
+		{"./child", "", "./child"},
+		{"../", "/a/b/", "../"},
+		// relative links that go above the root are clamped to it
+		{"../sibling", "/page", "/ns/svc/80/sibling"},
+		{"../sibling", "", "/ns/svc/80/sibling"},
+		{"../../toofar", "/a/page", "/ns/svc/80/toofar"},
+		{"../../toofar?q=1#f", "/a/b", "/ns/svc/80/toofar?q=1#f"},
+		{"../../../toofar/", "/a/b/", "/ns/svc/80/toofar/"},
+		{"../..", "/a/page", "/ns/svc/80/"},
+		// other links are rewritten by rewriteURL
+		{"/absolute", "/a/page", "/ns/svc/80/absolute"},
+		{"https://example.com/../x", "/page", "https://example.com/../x"},
+	}
+	for i, test := range tests {
+		output := rewriteURLFrom(test.input, rootPath, test.destPath)
+		if output != test.expected {
+			t.Errorf("%d: rewriteURLFrom(%#v, %#v, %#v)=%#v; expected %#v",
+				i, test.input, rootPath, test.destPath, output, test.expected)
+		}
+	}
+}
+
+func TestRewriteHTML(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := rewriteAbsolutePathLinks(out, strings.NewReader(exampleHTML), "/extra/path", rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustContain := []string{
+		`"https://www.example.com/absolute"`,
+		`"/extra/path/rootrelative"`,
+		`"./dir/relative1"`,
+		`"/extra/path/root/post"`,
+		`src="/extra/path/logo.png"`,
+		`srcset="/extra/path/logo-1x.png 1x,  /extra/path/logo-2x.png 2x, https://cdn.example.com/logo-3x.png 3x"`,
+		// Checks for https://github.com/golang/go/issues/7929
+		`"use strict";`,
+	}
+	for i, s := range mustContain {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("%d: output must contain %#v\n%s", i, s, out.String())
+		}
+	}
+}
+
+func TestProxyRewritesStylesheetsAndScripts(t *testing.T) {
+	const page = `<html><head>
+<link rel="stylesheet" href="/static/app.css">
+<link rel="icon" href="/favicon.ico">
+<script src="/static/app.js"></script>
+<script>var path = "/inline/not/rewritten";</script>
+</head><body></body></html>`
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(page))
+	}))
+	kwp := newServer(fakeAPI)
+
+	root := fmt.Sprintf("/namespace/service/%d/", port)
+	r := httptest.NewRequest(http.MethodGet, root, nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	mustContain := []string{
+		`<link rel="stylesheet" href="` + root + `static/app.css">`,
+		`<link rel="icon" href="` + root + `favicon.ico">`,
+		`<script src="` + root + `static/app.js"></script>`,
+		`<script>var path = "/inline/not/rewritten";</script>`,
+	}
+	for _, s := range mustContain {
+		if !strings.Contains(recorder.Body.String(), s) {
+			t.Errorf("output must contain %#v\n%s", s, recorder.Body.String())
+		}
+	}
+}
+
+func TestRewriteOriginLinks(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`<link rel="preconnect" href="/">`, `<link rel="preconnect" href="/">`},
+		{`<link rel="dns-prefetch" href="//cdn.example.com">`, `<link rel="dns-prefetch" href="//cdn.example.com">`},
+		{`<link rel="PreConnect" href="/">`, `<link rel="PreConnect" href="/">`},
+		{`<link rel="stylesheet" href="/app.css">`, `<link rel="stylesheet" href="/extra/path/app.css">`},
+		{`<link rel="icon" href="/favicon.ico">`, `<link rel="icon" href="/extra/path/favicon.ico">`},
+		{`<link rel="manifest" href="/manifest.json">`, `<link rel="manifest" href="/extra/path/manifest.json">`},
+	}
+	for i, test := range tests {
+		out := &bytes.Buffer{}
+		err := rewriteAbsolutePathLinks(out, strings.NewReader(test.input), "/extra/path", rewriteOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.expected {
+			t.Errorf("%d: rewrite(%#v)=%#v; expected %#v", i, test.input, out.String(), test.expected)
+		}
+	}
+}
+
+func TestRewriteMedia(t *testing.T) {
+	const input = `<video src="/v.mp4" poster="/poster.jpg">` +
+		`<source src="/v.webm" type="video/webm">` +
+		`<track src="/subs/en.vtt" srclang="en" label="/English" kind="subtitles">` +
+		`</video><audio src="/a.mp3"></audio>` +
+		`<picture><source srcset="/big.png 2x"></picture>`
+	const expected = `<video src="/root/v.mp4" poster="/root/poster.jpg">` +
+		`<source src="/root/v.webm" type="video/webm">` +
+		`<track src="/root/subs/en.vtt" srclang="en" label="/English" kind="subtitles">` +
+		`</video><audio src="/root/a.mp3"></audio>` +
+		`<picture><source srcset="/root/big.png 2x"></picture>`
+	out := &bytes.Buffer{}
+	err := rewriteAbsolutePathLinks(out, strings.NewReader(input), "/root", rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("rewritten HTML=\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestRewriteSrcsetLikeLinks(t *testing.T) {
+	const input = `<img src="../up.png" srcset="../up.png 1x, https://proxy.example.com/own.png 2x">` +
+		`<picture><source srcset="https://proxy.example.com/big.png 2x, ../../far.png 3x"></picture>`
+	const expected = `<img src="/root/up.png" srcset="/root/up.png 1x, /root/own.png 2x">` +
+		`<picture><source srcset="/root/big.png 2x, /root/far.png 3x"></picture>`
+	out := &bytes.Buffer{}
+	err := rewriteAbsolutePathLinks(out, strings.NewReader(input), "/root", rewriteOptions{
+		destPath: "/page", proxyHosts: map[string]bool{"proxy.example.com": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("rewritten HTML=\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestRewriteBase(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`<base href="/app/">`, `<base href="/extra/path/app/">`},
+		{`<base href="/">`, `<base href="/extra/path/">`},
+		{`<base href="app/">`, `<base href="app/">`},
+		{`<base href="https://example.com/app/">`, `<base href="https://example.com/app/">`},
+		{`<base target="_blank">`, `<base target="_blank">`},
+	}
+	for i, test := range tests {
+		out := &bytes.Buffer{}
+		err := rewriteAbsolutePathLinks(out, strings.NewReader(test.input), "/extra/path", rewriteOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.expected {
+			t.Errorf("%d: rewrite(%#v)=%#v; expected %#v", i, test.input, out.String(), test.expected)
+		}
+	}
+}
+
+func TestRewriteLazyAttrs(t *testing.T) {
+	const input = `<img data-src="/img.png" data-srcset="/small.png 1x, /large.png 2x">`
+	out := &bytes.Buffer{}
+	err := rewriteAbsolutePathLinks(out, strings.NewReader(input), "/extra/path", rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `data-src="/img.png"`) {
+		t.Errorf("data-src must not be rewritten by default: %s", out.String())
+	}
+
+	out.Reset()
+	err = rewriteAbsolutePathLinks(out, strings.NewReader(input), "/extra/path",
+		rewriteOptions{lazyAttrs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustContain := []string{
+		`data-src="/extra/path/img.png"`,
+		`data-srcset="/extra/path/small.png 1x, /extra/path/large.png 2x"`,
+	}
+	for i, s := range mustContain {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("%d: output must contain %#v\n%s", i, s, out.String())
+		}
+	}
+}
+
+func TestRewritePreloadImagesrcset(t *testing.T) {
+	const input = `<link rel="preload" as="image" imagesrcset="/a.png 1x, /b.png 2x" imagesizes="50vw">`
+	out := &bytes.Buffer{}
+	err := rewriteAbsolutePathLinks(out, strings.NewReader(input), "/extra/path", rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustContain := []string{
+		`imagesrcset="/extra/path/a.png 1x, /extra/path/b.png 2x"`,
+		`imagesizes="50vw"`,
+	}
+	for i, s := range mustContain {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("%d: output must contain %#v\n%s", i, s, out.String())
+		}
+	}
+}
+
+func TestRewriteNoopener(t *testing.T) {
+	const input = `<a href="/new" target="_blank">new</a>` +
+		`<a href="/frame" target="content">frame</a>` +
+		`<a href="/rel" target="_BLANK" rel="external">rel</a>` +
+		`<a href="/already" target="_blank" rel="noopener">already</a>`
+	out := &bytes.Buffer{}
+	err := rewriteAbsolutePathLinks(out, strings.NewReader(input), "/extra/path",
+		rewriteOptions{noopener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<a href="/extra/path/new" target="_blank" rel="noopener">new</a>` +
+		`<a href="/extra/path/frame" target="content">frame</a>` +
+		`<a href="/extra/path/rel" target="_BLANK" rel="external noopener">rel</a>` +
+		`<a href="/extra/path/already" target="_blank" rel="noopener">already</a>`
+	if out.String() != expected {
+		t.Errorf("output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestProxyXHTML(t *testing.T) {
+	const xhtml = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:svg="http://www.w3.org/2000/svg">
+<body>
+<a href="/rootrelative">link</a><br/>
+<svg:svg viewBox="0 0 10 10"><svg:rect width="1" height="1"/></svg:svg>
+<p>&lt;escaped&gt; &amp; text</p>
+</body></html>`
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xhtml+xml; charset=utf-8")
+		w.Write([]byte(xhtml))
+	}))
+	kwp := newServer(fakeAPI)
+
+	goodRoot := fmt.Sprintf("/namespace/service/%d/", port)
+	r := httptest.NewRequest(http.MethodGet, goodRoot, nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	expected := strings.Replace(xhtml, `"/rootrelative"`, `"`+goodRoot+`rootrelative"`, 1)
+	if recorder.Body.String() != expected {
+		t.Errorf("unexpected XHTML output:\n%s\nexpected:\n%s", recorder.Body.String(), expected)
+	}
+}
+
+func TestProxyEmptyHTML(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", "0")
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.banners = map[string]string{defaultBannerKey: "banner"}
+	proxyServer := httptest.NewServer(http.HandlerFunc(kwp.proxyErrWrapper))
+	defer proxyServer.Close()
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		r, err := http.NewRequest(method, fmt.Sprintf("%s/namespace/service/%d/", proxyServer.URL, port), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || len(body) != 0 {
+			t.Errorf("%s: status=%d body=%#v; expected 200 with empty body", method, resp.StatusCode, string(body))
+		}
+		if method == http.MethodGet && resp.ContentLength != 0 {
+			t.Errorf("%s: ContentLength=%d; expected 0", method, resp.ContentLength)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	fakeAPI := &fakeKubernetesAPIClient{}
+	kwp := newServer(fakeAPI)
+	handler := kwp.makeSecureHandler("noaudience")
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Error("health check should return 200 OK", resp.Code)
+	}
+}
+
+func TestReady(t *testing.T) {
+	fakeAPI := &fakeKubernetesAPIClient{}
+	kwp := newServer(fakeAPI)
+	handler := kwp.makeSecureHandler("noaudience")
+
+	req := httptest.NewRequest(http.MethodGet, readyPath, nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Error("ready check should return 200 OK without auth", resp.Code, resp.Body.String())
+	}
+	if fakeAPI.lastListOptions.limit != 1 {
+		t.Errorf("ready check must list a single service: %#v", fakeAPI.lastListOptions)
+	}
+
+	// listing fails: not ready, but still alive
+	fakeAPI.forbiddenNamespaces = map[string]bool{"namespace": true}
+	for path, expected := range map[string]int{
+		readyPath: http.StatusServiceUnavailable,
+		"/health": http.StatusOK,
+	} {
+		req = httptest.NewRequest(http.MethodGet, path, nil)
+		resp = httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		if resp.Code != expected {
+			t.Errorf("%s with a failing API: status=%d; expected %d", path, resp.Code, expected)
+		}
+	}
+}
+
+func TestCustomHealthPath(t *testing.T) {
+	kwp := newServer(&fakeKubernetesAPIClient{})
+	kwp.healthPath = "/ping"
+	handler := kwp.makeSecureHandler("noaudience")
+
+	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Error("custom health check should return 200 OK without auth", resp.Code)
+	}
+
+	// the default path is now protected
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code == http.StatusOK {
+		t.Error("/health must require auth when the health path is changed", resp.Code)
+	}
+
+	for _, invalid := range []string{"", "/", "ping", "/a/b/c"} {
+		if validateHealthPath(invalid) == nil {
+			t.Errorf("validateHealthPath(%#v) should fail", invalid)
+		}
+	}
+	if err := validateHealthPath("/ping"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRobots(t *testing.T) {
+	fakeAPI := &fakeKubernetesAPIClient{}
+	kwp := newServer(fakeAPI)
+	handler := kwp.makeSecureHandler("noaudience")
+
+	req := httptest.NewRequest(http.MethodGet, "/robots.txt", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Error("robots.txt should return 200 OK", resp.Code)
+	}
+	if resp.Body.String() != robotsDisallowAll {
+		t.Errorf("robots.txt=%#v; expected %#v", resp.Body.String(), robotsDisallowAll)
+	}
+
+	kwp.allowIndexing = true
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Body.String() != robotsAllowAll {
+		t.Errorf("robots.txt=%#v; expected %#v", resp.Body.String(), robotsAllowAll)
+	}
+}
+
+func TestResolveListenAddr(t *testing.T) {
+	testCases := []struct {
+		listenAddr string
+		port       string
+		expected   string
+	}{
+		{"", "", ":" + defaultPort},
+		{"", "9000", ":9000"},
+		{"127.0.0.1:1234", "", "127.0.0.1:1234"},
+		{"127.0.0.1:1234", "9000", "127.0.0.1:1234"},
+	}
+	for _, test := range testCases {
+		addr := resolveListenAddr(test.listenAddr, test.port)
+		if addr != test.expected {
+			t.Errorf("resolveListenAddr(%#v, %#v)=%#v; expected %#v", test.listenAddr, test.port, addr, test.expected)
+		}
+	}
+}
+
+func TestNewHTTPServerTimeouts(t *testing.T) {
+	timeouts := serverTimeouts{time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second}
+	httpServer := newHTTPServer(":0", http.NotFoundHandler(), timeouts)
+	if httpServer.ReadHeaderTimeout != time.Second || httpServer.ReadTimeout != 2*time.Second ||
+		httpServer.WriteTimeout != 3*time.Second || httpServer.IdleTimeout != 4*time.Second {
+		t.Errorf("timeouts not applied: %#v", httpServer)
+	}
+	// long uploads must work by default
+	if defaultServerTimeouts.read != 0 || defaultServerTimeouts.readHeader == 0 {
+		t.Errorf("defaultServerTimeouts=%#v; expected only a read header timeout", defaultServerTimeouts)
+	}
+
+	// a client that never finishes sending headers must be disconnected
+	timeouts = serverTimeouts{readHeader: 50 * time.Millisecond}
+	testServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+	testServer.Config = newHTTPServer("", http.NotFoundHandler(), timeouts)
+	testServer.Start()
+	defer testServer.Close()
+
+	conn, err := net.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	if err != nil {
+		t.Error("server should have closed the slow connection:", err)
+	}
+}
+
+func TestHealthCheckHeader(t *testing.T) {
+	kwp := newServer(&fakeKubernetesAPIClient{})
+	var err error
+	kwp.healthCheckHeader, err = parseHealthCheckHeader("x-health-check: true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := kwp.makeSecureHandler("noaudience")
+
+	type testCase struct {
+		path     string
+		value    string
+		expected bool
+	}
+	testCases := []testCase{
+		{"/", "true", true},
+		{"/", "TRUE", true},
+		{"/", "false", false},
+		{"/", "", false},
+		{"/other", "true", false},
+	}
+	for i, test := range testCases {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.value != "" {
+			req.Header.Set("X-Health-Check", test.value)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		isHealthCheck := resp.Body.String() == "ok\n"
+		if isHealthCheck != test.expected {
+			t.Errorf("%d: path=%s X-Health-Check=%s: health check=%t (status=%d); expected %t",
+				i, test.path, test.value, isHealthCheck, resp.Code, test.expected)
+		}
+	}
+
+	// only the name: any value matches
+	anyValue, err := parseHealthCheckHeader("X-Health-Check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Health-Check", "anything")
+	if !anyValue.matches(req) {
+		t.Error("header without a value must match any value")
+	}
+	for _, invalid := range []string{":value", "X Health: true"} {
+		if _, err := parseHealthCheckHeader(invalid); err == nil {
+			t.Errorf("parseHealthCheckHeader(%#v) should fail", invalid)
+		}
+	}
+}
+
+func TestIsRootHealthCheck(t *testing.T) {
+	type testCase struct {
+		userAgent string
+		path      string
+		expected  bool
+	}
+	testCases := []testCase{
+		{"kube-probe/1.13+", "/", true},
+		{"kube-probe/1.17", "/", true},
+		{"GoogleHC/1.0", "/", true},
+		{"xGoogleHC/2.1", "/", true},
+
+		{"GoogleHCx/2.1", "/", false},
+		// real chrome
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/79.0.3945.117 Safari/537.36",
+			"/", false},
+		{"GoogleHC/1.0", "/other", false},
+	}
+	for i, test := range testCases {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r.Header.Set("User-Agent", test.userAgent)
+		result := isRootHealthCheck(r)
+		if result != test.expected {
+			t.Errorf("%d: isRootHealthCheck(User-Agent:%s Path:%s)=%t; expected %t",
+				i, test.userAgent, test.path, result, test.expected)
+		}
+	}
+}
+
+const exampleHTML = `<html><body>
+<a href="./dir/relative1">relative1</a>
+<a href="/rootrelative">rootrelative</a>
+<a href="https://www.example.com/absolute">absolute</a>
+<form method="post" action="/root/post">
+<img src="/logo.png" srcset="/logo-1x.png 1x,  /logo-2x.png 2x, https://cdn.example.com/logo-3x.png 3x">
+<script>
 function initPanAndZoom(svg, clickHandler) {
 	// x/net/html has a bug when printing scripts: https://github.com/golang/go/issues/7929
   "use strict";
 }
 </script>
 </body></html>`
+
+func TestRootFilterQuery(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	for _, ns := range [][2]string{{"team-a", "foo-frontend"}, {"team-b", "bar"}, {"foo", "db"}} {
+		f.services.Items = append(f.services.Items, corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns[0], Name: ns[1]},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+			},
+		})
+	}
+	s := newServer(f)
+
+	r := httptest.NewRequest(http.MethodGet, "/?q=FOO", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	body := recorder.Body.String()
+	for _, expected := range []string{`href="/team-a/foo-frontend/80/"`, `href="/foo/db/80/"`, `value="FOO"`} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %#v:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "/team-b/bar/") {
+		t.Error("must not list services that do not match", body)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/?q=team-b/bar", nil)
+	recorder = httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	body = recorder.Body.String()
+	if !strings.Contains(body, "/team-b/bar/") || strings.Contains(body, "/foo/db/") {
+		t.Error("must match namespace/name", body)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/?q=missing", nil)
+	recorder = httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	body = recorder.Body.String()
+	if !strings.Contains(body, "No services match") {
+		t.Error("expected a message when nothing matches", body)
+	}
+}
+
+func TestRootLabelsAndType(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	f.services.Items = append(f.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "svc",
+			Labels: map[string]string{"tier": "web", "app": "frontend"}},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeClusterIP,
+			Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}},
+		},
+	})
+	s := newServer(f)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	body := recorder.Body.String()
+	if !strings.Contains(body, "<small>(ClusterIP)</small>") {
+		t.Error("expected the service type", body)
+	}
+	app := strings.Index(body, "<code>app=frontend</code>")
+	tier := strings.Index(body, "<code>tier=web</code>")
+	if app < 0 || tier < 0 || app > tier {
+		t.Error("expected labels sorted by key", body)
+	}
+}
+
+func TestNoCacheProxiedContent(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Set("Expires", "Thu, 01 Dec 2094 16:00:00 GMT")
+		if strings.HasSuffix(r.URL.Path, ".js") {
+			w.Header().Set("Content-Type", "text/javascript")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		w.Write([]byte("hello"))
+	}))
+	kwp := newServer(fakeAPI)
+
+	tests := []struct {
+		enabled      bool
+		path         string
+		cacheControl string
+	}{
+		{false, "/page", "public, max-age=3600"},
+		{true, "/page", "no-store, private"},
+		// static assets can still be cached
+		{true, "/app.js", "public, max-age=3600"},
+	}
+	for _, test := range tests {
+		kwp.noCacheProxiedContent = test.enabled
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d%s", port, test.path), nil)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Header().Get("Cache-Control") != test.cacheControl {
+			t.Errorf("enabled=%t %s: Cache-Control=%#v; expected %#v", test.enabled, test.path,
+				recorder.Header().Get("Cache-Control"), test.cacheControl)
+		}
+		hasExpires := recorder.Header().Get("Expires") != ""
+		if hasExpires != (test.cacheControl != "no-store, private") {
+			t.Errorf("enabled=%t %s: Expires=%#v", test.enabled, test.path, recorder.Header().Get("Expires"))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Wraps a serviceInfo to reuse the result of list for ttl, so loading the service list does not
+// make an API call every time. The list may be stale for up to ttl after services change.
+type listCachingServiceInfo struct {
+	serviceInfo
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[listOptions]cachedList
+}
+
+type cachedList struct {
+	services *corev1.ServiceList
+	expires  time.Time
+}
+
+func newListCachingServiceInfo(services serviceInfo, ttl time.Duration) *listCachingServiceInfo {
+	return &listCachingServiceInfo{
+		serviceInfo: services,
+		ttl:         ttl,
+		now:         time.Now,
+		entries:     map[listOptions]cachedList{},
+	}
+}
+
+func (c *listCachingServiceInfo) list(ctx context.Context, opts listOptions) (*corev1.ServiceList, error) {
+	if opts.limit != 0 || opts.continueToken != "" {
+		// pages are requested by clients: caching them would let clients grow the cache
+		return c.serviceInfo.list(ctx, opts)
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[opts]
+	c.mu.Unlock()
+	if !ok || !c.now().Before(entry.expires) {
+		services, err := c.serviceInfo.list(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		now := c.now()
+		entry = cachedList{services, now.Add(c.ttl)}
+		c.mu.Lock()
+		for key, other := range c.entries {
+			if !now.Before(other.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.entries[opts] = entry
+		c.mu.Unlock()
+	}
+
+	// callers sort the items: give each caller its own slice
+	services := *entry.services
+	services.Items = append([]corev1.Service(nil), entry.services.Items...)
+	return &services, nil
+}
+
+// Loads the service list shown on the root page, so the first request does not wait for it.
+func (s *server) warmServiceCache(ctx context.Context) error {
+	start := time.Now()
+	services, err := s.services.list(ctx, s.listOptions)
+	if err != nil {
+		return err
+	}
+	s.logger.info("warmed service cache", logFields{"services": len(services.Items),
+		"duration_ms": time.Since(start).Milliseconds()})
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWarmServiceCache(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	f.services.Items = append(f.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}}},
+	})
+	s := newServer(f)
+	cache := newListCachingServiceInfo(s.services, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	s.services = cache
+
+	err := s.warmServiceCache(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.listCalls != 1 {
+		t.Errorf("listCalls=%d after warming; expected 1", f.listCalls)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	if !strings.Contains(recorder.Body.String(), `href="/namespace/service/80/"`) {
+		t.Errorf("root page should list the cached service:\n%s", recorder.Body.String())
+	}
+	if f.listCalls != 1 {
+		t.Errorf("listCalls=%d after the first root request; expected the cached list", f.listCalls)
+	}
+
+	// after the TTL the list is loaded again
+	now = now.Add(time.Minute)
+	s.rootHandler(httptest.NewRecorder(), r)
+	if f.listCalls != 2 {
+		t.Errorf("listCalls=%d after expiry; expected 2", f.listCalls)
+	}
+}
+
+func TestListCacheEntries(t *testing.T) {
+	f := &fakeKubernetesAPIClient{}
+	cache := newListCachingServiceInfo(f, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// pages are not cached
+	for i := 0; i < 2; i++ {
+		_, err := cache.list(ctx, listOptions{limit: 1, continueToken: "0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.listCalls != 2 || len(cache.entries) != 0 {
+		t.Errorf("listCalls=%d entries=%d; expected pages to not be cached", f.listCalls, len(cache.entries))
+	}
+
+	// expired entries are removed when another list is stored
+	_, err := cache.list(ctx, listOptions{namespace: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	_, err = cache.list(ctx, listOptions{namespace: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.entries[listOptions{namespace: "a"}]; ok || len(cache.entries) != 1 {
+		t.Errorf("entries=%v; expected only namespace b", cache.entries)
+	}
+}
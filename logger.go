@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Structured fields attached to a log message, e.g. namespace, service and status.
+type logFields map[string]interface{}
+
+// Writes log messages with structured fields, either as text with the standard log package
+// (-logFormat=text) or as one JSON object per line (-logFormat=json) for Cloud Logging.
+type logger struct {
+	mu sync.Mutex
+	// if nil, messages are written as text with the log package
+	jsonOut io.Writer
+}
+
+func newTextLogger() *logger {
+	return &logger{}
+}
+
+func newJSONLogger(out io.Writer) *logger {
+	return &logger{jsonOut: out}
+}
+
+func (l *logger) info(msg string, fields logFields) {
+	l.write("INFO", msg, fields)
+}
+
+func (l *logger) warning(msg string, fields logFields) {
+	l.write("WARNING", msg, fields)
+}
+
+func (l *logger) write(severity string, msg string, fields logFields) {
+	if l.jsonOut == nil {
+		l.writeText(severity, msg, fields)
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+3)
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["severity"] = severity
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["msg"] = msg
+	line, err := json.Marshal(entry)
+	if err != nil {
+		// should be impossible: fields are strings and numbers
+		log.Printf("warning: failed to marshal log entry %#v: %s", entry, err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.jsonOut.Write(line)
+	if err != nil {
+		log.Printf("warning: failed to write log entry: %s", err.Error())
+	}
+}
+
+// Writes msg followed by key=value pairs sorted by key, quoting values containing spaces.
+func (l *logger) writeText(severity string, msg string, fields logFields) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := &strings.Builder{}
+	if severity == "WARNING" {
+		out.WriteString("warning: ")
+	}
+	out.WriteString(msg)
+	for _, key := range keys {
+		value := fmt.Sprint(fields[key])
+		if value == "" || strings.ContainsAny(value, " \t\n\"") {
+			value = fmt.Sprintf("%#v", value)
+		}
+		fmt.Fprintf(out, " %s=%s", key, value)
+	}
+	log.Print(out.String())
+}
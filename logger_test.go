@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoggerText(t *testing.T) {
+	logOutput := &bytes.Buffer{}
+	log.SetOutput(logOutput)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	l := newTextLogger()
+	l.info("message", logFields{"b": 2, "a": "value", "space": "has space", "empty": ""})
+	l.warning("careful", nil)
+	expected := "message a=value b=2 empty=\"\" space=\"has space\"\nwarning: careful\n"
+	if logOutput.String() != expected {
+		t.Errorf("text log=%#v; expected %#v", logOutput.String(), expected)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/link">link</a>`))
+	}))
+	kwp := newServer(fakeAPI)
+	logOutput := &bytes.Buffer{}
+	kwp.logger = newJSONLogger(logOutput)
+
+	// nothing may be written with the log package, which would mix text with the JSON lines
+	textOutput := &bytes.Buffer{}
+	log.SetOutput(textOutput)
+	defer log.SetOutput(os.Stderr)
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	kwp.rootHandler(httptest.NewRecorder(), r)
+	if textOutput.Len() != 0 {
+		t.Errorf("text written with the log package:\n%s", textOutput.String())
+	}
+
+	output := logOutput.String()
+	var proxied map[string]interface{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("invalid JSON log line %#v: %s", scanner.Text(), err)
+		}
+		for _, key := range []string{"msg", "severity", "time"} {
+			if _, ok := entry[key]; !ok {
+				t.Errorf("log line %#v is missing key %s", scanner.Text(), key)
+			}
+		}
+		if entry["msg"] == "proxied" {
+			proxied = entry
+		}
+	}
+	if proxied == nil {
+		t.Fatalf("missing proxied log line:\n%s", output)
+	}
+	for _, key := range []string{"namespace", "service", "method", "status", "duration_ms", "remote_addr"} {
+		if _, ok := proxied[key]; !ok {
+			t.Errorf("proxied log line is missing key %s: %#v", key, proxied)
+		}
+	}
+	if proxied["namespace"] != "namespace" || proxied["service"] != "service" || proxied["status"] != 200.0 {
+		t.Errorf("unexpected proxied log line: %#v", proxied)
+	}
+	if !strings.Contains(output, `"msg":"rewriting HTML paths"`) {
+		t.Errorf("proxyRewriter must log with the JSON logger:\n%s", output)
+	}
+}
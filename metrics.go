@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const metricsPath = "/metrics"
+
+// Upper bounds of the request duration histogram buckets in seconds: the Prometheus defaults.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestMetricLabels struct {
+	namespace string
+	service   string
+	code      int
+}
+
+type durationMetricLabels struct {
+	namespace string
+	service   string
+}
+
+// Results of rewriting a Location header, for the redirect metric.
+const (
+	locationRewritten = "rewritten"
+	locationUnchanged = "unchanged"
+	// the Location could not be parsed, so it was sent unchanged
+	locationInvalid = "invalid"
+)
+
+type locationMetricLabels struct {
+	namespace string
+	service   string
+	result    string
+}
+
+type durationHistogram struct {
+	// counts[i] is the number of observations <= durationBuckets[i]; not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Counts proxied requests and their durations, and serves them in the Prometheus text format.
+// This is a tiny subset of the Prometheus client library, which we do not need for two metrics.
+type proxyMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestMetricLabels]uint64
+	durations map[durationMetricLabels]*durationHistogram
+	locations map[locationMetricLabels]uint64
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		requests:  map[requestMetricLabels]uint64{},
+		durations: map[durationMetricLabels]*durationHistogram{},
+		locations: map[locationMetricLabels]uint64{},
+	}
+}
+
+func (m *proxyMetrics) observe(namespace string, service string, code int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestMetricLabels{namespace, service, code}]++
+
+	key := durationMetricLabels{namespace, service}
+	histogram := m.durations[key]
+	if histogram == nil {
+		histogram = &durationHistogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[key] = histogram
+	}
+	seconds := duration.Seconds()
+	bucket := sort.SearchFloat64s(durationBuckets, seconds)
+	if bucket < len(durationBuckets) {
+		histogram.counts[bucket]++
+	}
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// Counts a Location header in a proxied response, with result one of the location* constants.
+func (m *proxyMetrics) observeLocation(namespace string, service string, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locations[locationMetricLabels{namespace, service, result}]++
+}
+
+// The namespace and service labels of a proxied request. Only requests for services that were
+// found and allowed are labeled, so requests for arbitrary paths cannot create unbounded numbers
+// of metrics. Pods are not labeled by name, since pods that come and go would do the same.
+type proxyMetricLabels struct {
+	namespace string
+	service   string
+}
+
+func serviceMetricLabels(service *corev1.Service, isPod bool) proxyMetricLabels {
+	if isPod {
+		return proxyMetricLabels{service.Namespace, ""}
+	}
+	return proxyMetricLabels{service.Namespace, service.Name}
+}
+
+// Escapes a label value for the Prometheus text format.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (m *proxyMetrics) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requestKeys := make([]requestMetricLabels, 0, len(m.requests))
+	for key := range m.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		if requestKeys[i].namespace != requestKeys[j].namespace {
+			return requestKeys[i].namespace < requestKeys[j].namespace
+		}
+		if requestKeys[i].service != requestKeys[j].service {
+			return requestKeys[i].service < requestKeys[j].service
+		}
+		return requestKeys[i].code < requestKeys[j].code
+	})
+	fmt.Fprintln(out, "# HELP kubewebproxy_requests_total Proxied requests.")
+	fmt.Fprintln(out, "# TYPE kubewebproxy_requests_total counter")
+	for _, key := range requestKeys {
+		fmt.Fprintf(out, "kubewebproxy_requests_total{namespace=\"%s\",service=\"%s\",code=\"%d\"} %d\n",
+			labelValueEscaper.Replace(key.namespace), labelValueEscaper.Replace(key.service),
+			key.code, m.requests[key])
+	}
+
+	durationKeys := make([]durationMetricLabels, 0, len(m.durations))
+	for key := range m.durations {
+		durationKeys = append(durationKeys, key)
+	}
+	sort.Slice(durationKeys, func(i, j int) bool {
+		if durationKeys[i].namespace != durationKeys[j].namespace {
+			return durationKeys[i].namespace < durationKeys[j].namespace
+		}
+		return durationKeys[i].service < durationKeys[j].service
+	})
+	fmt.Fprintln(out, "# HELP kubewebproxy_request_duration_seconds Duration of proxied requests.")
+	fmt.Fprintln(out, "# TYPE kubewebproxy_request_duration_seconds histogram")
+	for _, key := range durationKeys {
+		histogram := m.durations[key]
+		labels := fmt.Sprintf("namespace=\"%s\",service=\"%s\"",
+			labelValueEscaper.Replace(key.namespace), labelValueEscaper.Replace(key.service))
+		cumulative := uint64(0)
+		for i, upperBound := range durationBuckets {
+			cumulative += histogram.counts[i]
+			fmt.Fprintf(out, "kubewebproxy_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, formatFloat(upperBound), cumulative)
+		}
+		fmt.Fprintf(out, "kubewebproxy_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n",
+			labels, histogram.count)
+		fmt.Fprintf(out, "kubewebproxy_request_duration_seconds_sum{%s} %s\n",
+			labels, formatFloat(histogram.sum))
+		fmt.Fprintf(out, "kubewebproxy_request_duration_seconds_count{%s} %d\n",
+			labels, histogram.count)
+	}
+
+	locationKeys := make([]locationMetricLabels, 0, len(m.locations))
+	for key := range m.locations {
+		locationKeys = append(locationKeys, key)
+	}
+	sort.Slice(locationKeys, func(i, j int) bool {
+		if locationKeys[i].namespace != locationKeys[j].namespace {
+			return locationKeys[i].namespace < locationKeys[j].namespace
+		}
+		if locationKeys[i].service != locationKeys[j].service {
+			return locationKeys[i].service < locationKeys[j].service
+		}
+		return locationKeys[i].result < locationKeys[j].result
+	})
+	fmt.Fprintln(out, "# HELP kubewebproxy_location_rewrites_total Location headers in proxied responses, by result.")
+	fmt.Fprintln(out, "# TYPE kubewebproxy_location_rewrites_total counter")
+	for _, key := range locationKeys {
+		fmt.Fprintf(out, "kubewebproxy_location_rewrites_total{namespace=\"%s\",service=\"%s\",result=\"%s\"} %d\n",
+			labelValueEscaper.Replace(key.namespace), labelValueEscaper.Replace(key.service),
+			key.result, m.locations[key])
+	}
+}
+
+// Serves the metrics in the Prometheus text format. This is not protected by IAP, like the
+// health check, so Prometheus can scrape it from inside the cluster.
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.write(w)
+}
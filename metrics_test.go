@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	kwp := newServer(fakeAPI)
+	handler := kwp.makeSecureHandler("noaudience")
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d%s", port, path), nil)
+		kwp.proxyErrWrapper(httptest.NewRecorder(), r)
+	}
+	// services that do not exist are not labeled
+	r := httptest.NewRequest(http.MethodGet, "/namespace/unknown/80/", nil)
+	kwp.proxyErrWrapper(httptest.NewRecorder(), r)
+
+	// served without auth
+	r = httptest.NewRequest(http.MethodGet, metricsPath, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status=%d; expected OK; body=%s", recorder.Code, recorder.Body.String())
+	}
+	for _, expected := range []string{
+		`kubewebproxy_requests_total{namespace="namespace",service="service",code="200"} 2` + "\n",
+		`kubewebproxy_requests_total{namespace="namespace",service="service",code="404"} 1` + "\n",
+		`kubewebproxy_request_duration_seconds_bucket{namespace="namespace",service="service",le="+Inf"} 3` + "\n",
+		`kubewebproxy_request_duration_seconds_count{namespace="namespace",service="service"} 3` + "\n",
+		`kubewebproxy_requests_total{namespace="",service="",code="404"} 1` + "\n",
+	} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("metrics must contain %#v:\n%s", expected, recorder.Body.String())
+		}
+	}
+	if strings.Contains(recorder.Body.String(), "unknown") {
+		t.Errorf("metrics must not label services that do not exist:\n%s", recorder.Body.String())
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	m := newProxyMetrics()
+	m.observe("ns", `a"b`, 200, 10*time.Millisecond)
+	m.observe("ns", `a"b`, 200, time.Minute)
+	out := &strings.Builder{}
+	m.write(out)
+	for _, expected := range []string{
+		`kubewebproxy_request_duration_seconds_bucket{namespace="ns",service="a\"b",le="0.005"} 0` + "\n",
+		`kubewebproxy_request_duration_seconds_bucket{namespace="ns",service="a\"b",le="0.01"} 1` + "\n",
+		`kubewebproxy_request_duration_seconds_bucket{namespace="ns",service="a\"b",le="10"} 1` + "\n",
+		`kubewebproxy_request_duration_seconds_bucket{namespace="ns",service="a\"b",le="+Inf"} 2` + "\n",
+		`kubewebproxy_request_duration_seconds_sum{namespace="ns",service="a\"b"} 60.01` + "\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("metrics must contain %#v:\n%s", expected, out.String())
+		}
+	}
+
+}
+
+func TestMetricsLocationRewrites(t *testing.T) {
+	locations := map[string]string{
+		"/login":    "/login",
+		"/external": "https://external.example/",
+		"/invalid":  "/bad%zz",
+	}
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", locations[r.URL.Path])
+		w.WriteHeader(http.StatusFound)
+	}))
+	kwp := newServer(fakeAPI)
+
+	for _, path := range []string{"/login", "/login", "/external", "/invalid"} {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d%s", port, path), nil)
+		recorder := httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if path == "/invalid" && recorder.Header().Get("Location") != "/bad%zz" {
+			t.Errorf("invalid Location must be passed through; Location=%#v", recorder.Header().Get("Location"))
+		}
+	}
+
+	out := &strings.Builder{}
+	kwp.metrics.write(out)
+	for _, expected := range []string{
+		`kubewebproxy_location_rewrites_total{namespace="namespace",service="service",result="rewritten"} 2` + "\n",
+		`kubewebproxy_location_rewrites_total{namespace="namespace",service="service",result="unchanged"} 1` + "\n",
+		`kubewebproxy_location_rewrites_total{namespace="namespace",service="service",result="invalid"} 1` + "\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("metrics must contain %#v:\n%s", expected, out.String())
+		}
+	}
+}
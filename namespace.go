@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variable containing the proxy's namespace, usually set with the downward API.
+const podNamespaceEnvVar = "POD_NAMESPACE"
+
+// File containing the namespace of the pod's service account, mounted in every pod by default.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Returns the namespace the proxy runs in, from podNamespaceEnvVar or namespaceFile.
+func podNamespace(namespaceFile string) (string, error) {
+	if namespace := os.Getenv(podNamespaceEnvVar); namespace != "" {
+		return namespace, nil
+	}
+	data, err := os.ReadFile(namespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("could not determine the proxy's namespace: set %s or mount %s: %w",
+			podNamespaceEnvVar, namespaceFile, err)
+	}
+	namespace := strings.TrimSpace(string(data))
+	if namespace == "" {
+		return "", fmt.Errorf("could not determine the proxy's namespace: %s is empty", namespaceFile)
+	}
+	return namespace, nil
+}
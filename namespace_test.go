@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodNamespace(t *testing.T) {
+	t.Setenv(podNamespaceEnvVar, "")
+	namespaceFile := filepath.Join(t.TempDir(), "namespace")
+	_, err := podNamespace(namespaceFile)
+	if err == nil {
+		t.Error("podNamespace without the file should fail")
+	}
+
+	err = os.WriteFile(namespaceFile, []byte("from-file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespace, err := podNamespace(namespaceFile)
+	if err != nil || namespace != "from-file" {
+		t.Errorf("podNamespace()=%#v, %v; expected from-file", namespace, err)
+	}
+
+	t.Setenv(podNamespaceEnvVar, "from-env")
+	namespace, err = podNamespace(namespaceFile)
+	if err != nil || namespace != "from-env" {
+		t.Errorf("podNamespace()=%#v, %v; expected from-env", namespace, err)
+	}
+}
+
+func TestSameNamespaceOnly(t *testing.T) {
+	t.Setenv(podNamespaceEnvVar, "")
+	namespaceFile := filepath.Join(t.TempDir(), "namespace")
+	err := os.WriteFile(namespaceFile, []byte("namespace"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	otherService := fakeAPI.services.Items[0]
+	otherService.ObjectMeta = metav1.ObjectMeta{Namespace: "other", Name: "service"}
+	fakeAPI.services.Items = append(fakeAPI.services.Items, otherService)
+	kwp := newServer(fakeAPI)
+	kwp.listOptions.namespace, err = podNamespace(namespaceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("same namespace: status=%d body=%s", recorder.Code, recorder.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/other/service/%d/", port), nil)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("other namespace: status=%d; expected NotFound", recorder.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder = httptest.NewRecorder()
+	kwp.rootHandler(recorder, r)
+	if strings.Contains(recorder.Body.String(), "/other/service/") {
+		t.Errorf("root page must not list other namespaces:\n%s", recorder.Body.String())
+	}
+}
+
+func TestNamespaceScoped(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	otherService := fakeAPI.services.Items[0]
+	otherService.ObjectMeta = metav1.ObjectMeta{Namespace: "other", Name: "service"}
+	fakeAPI.services.Items = append(fakeAPI.services.Items, otherService)
+	kwp := newServer(fakeAPI)
+	kwp.pods = &fakePodClient{[]corev1.Pod{newTestPod("127.0.0.1", port)}}
+	kwp.listOptions.namespace = "other"
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	kwp.rootHandler(recorder, r)
+	if fakeAPI.lastListOptions.namespace != "other" {
+		t.Errorf("must list services in the namespace only: %#v", fakeAPI.lastListOptions)
+	}
+	if !strings.Contains(recorder.Body.String(), "/other/service/") ||
+		strings.Contains(recorder.Body.String(), "/namespace/service/") {
+		t.Errorf("root page must only list the namespace:\n%s", recorder.Body.String())
+	}
+
+	for _, path := range []string{
+		fmt.Sprintf("/namespace/service/%d/", port),
+		fmt.Sprintf("/_pods/namespace/pod/%d/", port),
+	} {
+		r = httptest.NewRequest(http.MethodGet, path, nil)
+		recorder = httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%s: status=%d; expected NotFound", path, recorder.Code)
+		}
+	}
+
+	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/other/service/%d/", port), nil)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("same namespace: status=%d body=%s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Service annotation listing comma-separated paths of OpenAPI (or Swagger 2) documents. The
+// server URLs in these documents are rewritten to include the proxy prefix, so "Try it out" in
+// Swagger UI sends requests through the proxy.
+const rewriteOpenAPIAnnotation = "kubewebproxy.evanj/rewriteOpenAPI"
+
+// Returns true if destPath is one of the OpenAPI documents listed in the service's annotation.
+func isOpenAPIPath(annotations map[string]string, destPath string) bool {
+	for _, openAPIPath := range splitList(annotations[rewriteOpenAPIAnnotation]) {
+		if destPath == openAPIPath {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrites the OpenAPI document in resp so its server URLs start with rootPath. Documents that
+// cannot be parsed are passed through unchanged.
+func (s *server) rewriteOpenAPIResponse(resp *http.Response, rootPath string) error {
+	original, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	rewritten, err := rewriteOpenAPI(original, rootPath)
+	if err != nil {
+		s.logger.warning("not rewriting invalid OpenAPI document", logFields{"error": err.Error()})
+		rewritten = original
+	}
+	setRewrittenBody(resp, rewritten)
+	return nil
+}
+
+// Rewrites the servers[].url fields (OpenAPI 3) or basePath (Swagger 2) of an OpenAPI document.
+// Absent values default to "/", so they are added. Everything else is copied unchanged, in its
+// original order: Swagger UI shows operations in the order of the paths object.
+func rewriteOpenAPI(document []byte, rootPath string) ([]byte, error) {
+	doc, err := decodeJSONObject(document)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc.get("swagger") != nil {
+		var basePath string
+		if raw := doc.get("basePath"); raw != nil {
+			// a basePath that is not a string is replaced, like a missing one
+			json.Unmarshal(raw, &basePath)
+		}
+		if basePath == "" {
+			basePath = "/"
+		}
+		doc.set("basePath", marshalJSONString(rewriteURL(basePath, rootPath)))
+	} else if doc.get("openapi") != nil {
+		var servers []json.RawMessage
+		if raw := doc.get("servers"); raw != nil {
+			json.Unmarshal(raw, &servers)
+		}
+		if len(servers) == 0 {
+			servers = []json.RawMessage{json.RawMessage(`{"url":"/"}`)}
+		}
+		for i, server := range servers {
+			serverObject, err := decodeJSONObject(server)
+			if err != nil {
+				continue
+			}
+			var serverURL string
+			if json.Unmarshal(serverObject.get("url"), &serverURL) != nil {
+				continue
+			}
+			serverObject.set("url", marshalJSONString(rewriteURL(serverURL, rootPath)))
+			servers[i] = serverObject.encode()
+		}
+		out := []byte{'['}
+		for i, server := range servers {
+			if i > 0 {
+				out = append(out, ',')
+			}
+			out = append(out, server...)
+		}
+		doc.set("servers", append(out, ']'))
+	} else {
+		return nil, fmt.Errorf("missing openapi or swagger version field")
+	}
+	return doc.encode(), nil
+}
+
+// A JSON object with its members in their original order, and their values unparsed, so they
+// can be copied exactly. encoding/json sorts the keys of maps.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	key   string
+	value json.RawMessage
+}
+
+func decodeJSONObject(data []byte) (jsonObject, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	object := jsonObject{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := token.(string)
+		var value json.RawMessage
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+		object = append(object, jsonMember{key, value})
+	}
+	// the closing }
+	_, err = decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the document")
+	}
+	return object, nil
+}
+
+// Returns the value of key, or nil if it is absent.
+func (o jsonObject) get(key string) json.RawMessage {
+	for _, member := range o {
+		if member.key == key {
+			return member.value
+		}
+	}
+	return nil
+}
+
+// Replaces the value of key, or adds it at the end.
+func (o *jsonObject) set(key string, value json.RawMessage) {
+	for i := range *o {
+		if (*o)[i].key == key {
+			(*o)[i].value = value
+			return
+		}
+	}
+	*o = append(*o, jsonMember{key, value})
+}
+
+func (o jsonObject) encode() []byte {
+	out := []byte{'{'}
+	for i, member := range o {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		out = append(out, marshalJSONString(member.key)...)
+		out = append(out, ':')
+		out = append(out, member.value...)
+	}
+	return append(out, '}')
+}
+
+// Returns s as a JSON string. This is not embedded in HTML: <, > and & are not escaped.
+func marshalJSONString(s string) json.RawMessage {
+	out := &bytes.Buffer{}
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+	// encoding a string cannot fail
+	encoder.Encode(s)
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRewriteOpenAPI(t *testing.T) {
+	type testCase struct {
+		input    string
+		expected string
+	}
+	testCases := []testCase{
+		{`{"openapi":"3.0.0","servers":[{"url":"/api/v1"},{"url":"https://example.com/api"}]}`,
+			`{"openapi":"3.0.0","servers":[{"url":"/ns/svc/80/api/v1"},{"url":"https://example.com/api"}]}`},
+		{`{"openapi":"3.0.0","paths":{}}`,
+			`{"openapi":"3.0.0","paths":{},"servers":[{"url":"/ns/svc/80/"}]}`},
+		{`{"swagger":"2.0","basePath":"/v2"}`, `{"swagger":"2.0","basePath":"/ns/svc/80/v2"}`},
+		{`{"swagger":"2.0"}`, `{"swagger":"2.0","basePath":"/ns/svc/80/"}`},
+	}
+	for i, test := range testCases {
+		output, err := rewriteOpenAPI([]byte(test.input), "/ns/svc/80")
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		var outputValue, expectedValue interface{}
+		if err := json.Unmarshal(output, &outputValue); err != nil {
+			t.Fatal(i, err)
+		}
+		if err := json.Unmarshal([]byte(test.expected), &expectedValue); err != nil {
+			t.Fatal(i, err)
+		}
+		if !reflect.DeepEqual(outputValue, expectedValue) {
+			t.Errorf("%d: rewriteOpenAPI(%s)=%s; expected %s", i, test.input, output, test.expected)
+		}
+	}
+
+	// numbers and HTML characters are not changed
+	const exact = `{"openapi":"3.0.0","info":{"description":"a <b> & c","x-max":12345678901234567890}}`
+	output, err := rewriteOpenAPI([]byte(exact), "/ns/svc/80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"a <b> & c"`, `12345678901234567890`} {
+		if !strings.Contains(string(output), expected) {
+			t.Errorf("rewriteOpenAPI(%s)=%s; expected to contain %s", exact, output, expected)
+		}
+	}
+
+	// the document is only changed where it is rewritten: paths and fields keep their order
+	const ordered = `{"openapi":"3.0.0","paths":{"/z":{"post":{},"get":{}},"/a":{}},` +
+		`"servers":[{"url":"/api","description":"d"}],"info":{"title":"t"}}`
+	const orderedExpected = `{"openapi":"3.0.0","paths":{"/z":{"post":{},"get":{}},"/a":{}},` +
+		`"servers":[{"url":"/ns/svc/80/api","description":"d"}],"info":{"title":"t"}}`
+	output, err = rewriteOpenAPI([]byte(ordered), "/ns/svc/80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != orderedExpected {
+		t.Errorf("rewriteOpenAPI(%s)=%s; expected %s", ordered, output, orderedExpected)
+	}
+
+	for _, invalid := range []string{`not json`, `{"info":{}}`, `[]`, `{"openapi":"3.0.0"} {}`} {
+		_, err := rewriteOpenAPI([]byte(invalid), "/ns/svc/80")
+		if err == nil {
+			t.Errorf("rewriteOpenAPI(%#v) should fail", invalid)
+		}
+	}
+}
+
+func TestProxyRewriteOpenAPI(t *testing.T) {
+	const document = `{"openapi":"3.0.0","servers":[{"url":"/api"}]}`
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(document))
+	}))
+	fakeAPI.services.Items[0].Annotations = map[string]string{
+		rewriteOpenAPIAnnotation: "/swagger.json, /openapi.json",
+	}
+	kwp := newServer(fakeAPI)
+
+	root := fmt.Sprintf("/namespace/service/%d", port)
+	r := httptest.NewRequest(http.MethodGet, root+"/openapi.json", nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	expected := `{"openapi":"3.0.0","servers":[{"url":"` + root + `/api"}]}`
+	if recorder.Body.String() != expected {
+		t.Errorf("body=%s; expected %s", recorder.Body.String(), expected)
+	}
+
+	// other paths are not rewritten
+	r = httptest.NewRequest(http.MethodGet, root+"/other.json", nil)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Body.String() != document {
+		t.Errorf("body=%s; expected %s", recorder.Body.String(), document)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Proxies directly to a pod, e.g. to debug one replica: /_pods/(namespace)/(pod)/(port)(path).
+// This must be checked before servicePattern, which also matches these paths.
+var podPattern = regexp.MustCompile(`^/_pods/([^/]+)/([^/]+)/([^/]+)(.*)$`)
+
+type podInfo interface {
+	getPod(ctx context.Context, namespace string, name string) (*corev1.Pod, error)
+}
+
+func (k *kubernetesAPIClient) getPod(ctx context.Context, namespace string, name string) (*corev1.Pod, error) {
+	return k.clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// Returns a service with the pod's metadata, IP and container ports, so pods are proxied with the
+// same port checks and annotations as services. Returns an error if the pod has no IP.
+func serviceForPod(pod *corev1.Pod) (*corev1.Service, error) {
+	if pod.Status.PodIP == "" {
+		return nil, &statusError{http.StatusServiceUnavailable, fmt.Sprintf(
+			"pod %s/%s has no IP (phase %s) and cannot be proxied", pod.Namespace, pod.Name, pod.Status.Phase)}
+	}
+	service := &corev1.Service{
+		ObjectMeta: pod.ObjectMeta,
+		Spec:       corev1.ServiceSpec{ClusterIP: pod.Status.PodIP},
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, p := range container.Ports {
+			protocol := p.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+				Name:     p.Name,
+				Protocol: protocol,
+				Port:     p.ContainerPort,
+			})
+		}
+	}
+	return service, nil
+}
+
+// Returns if pod, returned by serviceForPod, may be proxied. The pod itself must be allowed by
+// authorize, and so must every service that selects it, so a denied service cannot be reached
+// through its pods.
+func (s *server) authorizePod(ctx context.Context, pod *corev1.Service) (accessDecision, error) {
+	if decision := s.authorize(pod); !decision.allowed {
+		return decision, nil
+	}
+	services, err := s.services.list(ctx, listOptions{namespace: pod.Namespace})
+	if err != nil {
+		return accessDecision{}, err
+	}
+	for i := range services.Items {
+		service := &services.Items[i]
+		if len(service.Spec.Selector) == 0 ||
+			!labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		if decision := s.authorize(service); !decision.allowed {
+			return accessDecision{false, fmt.Sprintf("selected by service %s: %s", service.Name, decision.reason)}, nil
+		}
+	}
+	return accessDecision{true, "allowed by default"}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type fakePodClient struct {
+	pods []corev1.Pod
+}
+
+func (f *fakePodClient) getPod(ctx context.Context, namespace string, name string) (*corev1.Pod, error) {
+	for i := range f.pods {
+		if f.pods[i].Namespace == namespace && f.pods[i].Name == name {
+			return &f.pods[i], nil
+		}
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, name)
+}
+
+func newTestPod(podIP string, port int) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "pod"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: int32(port)}},
+		}}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: podIP},
+	}
+}
+
+func TestProxyPod(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<a href="/link">path=%s</a>`, r.URL.Path)
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	s := newServer(&fakeKubernetesAPIClient{})
+	// the service template must not apply to pods
+	var err error
+	s.backendAddrTemplate, err = parseBackendAddrTemplate("invalid.example:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.pods = &fakePodClient{[]corev1.Pod{newTestPod("127.0.0.1", port)}}
+
+	for _, portSegment := range []string{fmt.Sprint(port), "http"} {
+		r := httptest.NewRequest(http.MethodGet, "/_pods/namespace/pod/"+portSegment+"/dir/", nil)
+		recorder := httptest.NewRecorder()
+		s.rootHandler(recorder, r)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("port %s: status=%d; body=%s", portSegment, recorder.Code, recorder.Body.String())
+		}
+		expected := fmt.Sprintf(`<a href="/_pods/namespace/pod/%s/link">path=/dir/</a>`, portSegment)
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("port %s: body=%#v; expected to contain %#v", portSegment, recorder.Body.String(), expected)
+		}
+	}
+
+	errorCases := []struct {
+		path string
+		code int
+	}{
+		{fmt.Sprintf("/_pods/namespace/missing/%d/", port), http.StatusNotFound},
+		{"/_pods/namespace/pod/1/", http.StatusNotFound},
+	}
+	for _, test := range errorCases {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		recorder := httptest.NewRecorder()
+		s.rootHandler(recorder, r)
+		if recorder.Code != test.code {
+			t.Errorf("%s: status=%d; expected %d", test.path, recorder.Code, test.code)
+		}
+	}
+
+	pending := newTestPod("", port)
+	pending.Status.Phase = corev1.PodPending
+	s.pods = &fakePodClient{[]corev1.Pod{pending}}
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/_pods/namespace/pod/%d/", port), nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("pod without IP: status=%d; expected %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+
+	s.pods = nil
+	recorder = httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("pods disabled: status=%d; expected %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestProxyPodDeniedService(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	fakeAPI := &fakeKubernetesAPIClient{}
+	fakeAPI.services.Items = append(fakeAPI.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "denied"}},
+	})
+	s := newServer(fakeAPI)
+	var err error
+	s.denyServices, err = parseServiceSet("namespace/service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := newTestPod("127.0.0.1", port)
+	selected.Labels = map[string]string{"app": "denied", "version": "1"}
+	other := newTestPod("127.0.0.1", port)
+	other.Name = "other"
+	other.Labels = map[string]string{"app": "other"}
+	s.pods = &fakePodClient{[]corev1.Pod{selected, other}}
+
+	testCases := []struct {
+		pod  string
+		code int
+	}{
+		{"pod", http.StatusNotFound},
+		{"other", http.StatusOK},
+	}
+	for _, test := range testCases {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/_pods/namespace/%s/%d/", test.pod, port), nil)
+		recorder := httptest.NewRecorder()
+		s.rootHandler(recorder, r)
+		if recorder.Code != test.code {
+			t.Errorf("pod %s: status=%d; expected %d", test.pod, recorder.Code, test.code)
+		}
+	}
+}
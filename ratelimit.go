@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/evanj/googlesignin/iap"
+	"golang.org/x/time/rate"
+)
+
+// Clients that have not made a request for this long are forgotten, so their buckets are full.
+const rateLimitIdleTimeout = 10 * time.Minute
+
+// Limits the request rate of each client with a token bucket per client.
+type clientRateLimiter struct {
+	limit rate.Limit
+	burst int
+	now   func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimit
+	lastPrune time.Time
+}
+
+type clientLimit struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientRateLimiter(perSecond float64, burst int) *clientRateLimiter {
+	return &clientRateLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		now:     time.Now,
+		clients: map[string]*clientLimit{},
+	}
+}
+
+// Returns true if client may make a request now. Otherwise returns false and how long until it may.
+func (l *clientRateLimiter) allow(client string) (bool, time.Duration) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > rateLimitIdleTimeout {
+		for key, other := range l.clients {
+			if now.Sub(other.lastSeen) > rateLimitIdleTimeout {
+				delete(l.clients, key)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	entry := l.clients[client]
+	if entry == nil {
+		entry = &clientLimit{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = entry
+	}
+	entry.lastSeen = now
+
+	reservation := entry.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return true, 0
+	}
+	// do not use the token: rejected requests should not delay later ones
+	reservation.CancelAt(now)
+	return false, delay
+}
+
+// Returns the email of the IAP user, or "" if the request was not authenticated by IAP, in
+// which case iap.Email panics.
+func iapEmail(r *http.Request) (email string) {
+	defer func() {
+		if recover() != nil {
+			email = ""
+		}
+	}()
+	return iap.Email(r)
+}
+
+// Returns the key used to rate limit r: the IAP user's email, or the remote IP.
+func rateLimitKey(r *http.Request) string {
+	if email := iapEmail(r); email != "" {
+		return "email:" + email
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Returns a handler that rejects requests over -rateLimit with 429 Too Many Requests, or handler
+// if rate limiting is disabled.
+func (s *server) rateLimited(handler http.Handler) http.Handler {
+	if s.rateLimiter == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := rateLimitKey(r)
+		allowed, delay := s.rateLimiter.allow(key)
+		if !allowed {
+			retryAfter := int(math.Ceil(delay.Seconds()))
+			s.logger.warning("rate limited", logFields{"client": key, "path": r.URL.Path,
+				"retry_after_s": retryAfter})
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "too many requests: try again later", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
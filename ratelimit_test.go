@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClientRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := newClientRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.allow("a"); !allowed {
+			t.Fatalf("request %d within the burst should be allowed", i)
+		}
+	}
+	allowed, delay := limiter.allow("a")
+	if allowed || delay != 500*time.Millisecond {
+		t.Errorf("over the burst: allowed=%t delay=%s; expected rejected for 500ms", allowed, delay)
+	}
+	// rejected requests do not use tokens
+	allowed, delay = limiter.allow("a")
+	if allowed || delay != 500*time.Millisecond {
+		t.Errorf("again: allowed=%t delay=%s; expected rejected for 500ms", allowed, delay)
+	}
+	// other clients have their own bucket
+	if allowed, _ := limiter.allow("b"); !allowed {
+		t.Error("another client should be allowed")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if allowed, _ := limiter.allow("a"); !allowed {
+		t.Error("should be allowed after the delay")
+	}
+
+	// idle clients are forgotten
+	now = now.Add(rateLimitIdleTimeout + time.Second)
+	limiter.allow("c")
+	if len(limiter.clients) != 1 {
+		t.Errorf("expected idle clients to be removed: %d clients", len(limiter.clients))
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	kwp := newServer(&fakeKubernetesAPIClient{})
+	kwp.rateLimiter = newClientRateLimiter(1, 5)
+	handler := kwp.rateLimited(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	limited := 0
+	for i := 0; i < 20; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/namespace/service/80/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		if recorder.Code == http.StatusTooManyRequests {
+			limited++
+			retryAfter, err := strconv.Atoi(recorder.Header().Get("Retry-After"))
+			if err != nil || retryAfter < 1 {
+				t.Errorf("Retry-After=%#v; expected a number of seconds", recorder.Header().Get("Retry-After"))
+			}
+		} else if recorder.Code != http.StatusOK {
+			t.Errorf("status=%d", recorder.Code)
+		}
+	}
+	// the test could be slow enough to earn another token
+	if limited < 14 || limited > 15 {
+		t.Errorf("limited=%d; expected 15 of 20 requests to be rate limited", limited)
+	}
+
+	// clients with a different IP have their own bucket
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.2:1234"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("another client: status=%d; expected OK", recorder.Code)
+	}
+
+	// health checks bypass the limiter, even for a rate limited client
+	secureHandler := kwp.makeSecureHandler("noaudience")
+	r = httptest.NewRequest(http.MethodGet, "/health", nil)
+	r.RemoteAddr = "192.0.2.1:5678"
+	recorder = httptest.NewRecorder()
+	secureHandler.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("health check: status=%d; expected OK", recorder.Code)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maximum number of services checked at the same time by reachabilityHandler
+const reachabilityConcurrency = 10
+const reachabilityTimeout = 10 * time.Second
+
+// The result of checking a single service. Exactly one of Status and Error is set. If Error is
+// set, Category classifies it.
+type reachabilityResult struct {
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Category errorCategory `json:"category,omitempty"`
+}
+
+func errorResult(err error) reachabilityResult {
+	return reachabilityResult{Error: err.Error(), Category: classifyError(err)}
+}
+
+// Returns the transport used to connect to backends.
+func (s *server) transport() http.RoundTripper {
+	if s.reverseProxy.Transport != nil {
+		return s.reverseProxy.Transport
+	}
+	return http.DefaultTransport
+}
+
+// Sends a HEAD request to the first TCP port of every displayed service, and returns a JSON map of
+// namespace/service/port to the result.
+func (s *server) reachabilityHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.info("reachabilityHandler", logFields{"method": r.Method,
+		"url": redactURL(r.URL, s.redactQueryParams)})
+	if r.Method != http.MethodGet {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// only probe services that are listed, so this does not reveal hidden or denied services
+	services, _, err := s.listDisplayedServices(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// do not follow redirects: we only want to know if the backend responds
+	client := &http.Client{
+		Transport: s.transport(),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	results := map[string]reachabilityResult{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, reachabilityConcurrency)
+	for i := range services.Items {
+		service := &services.Items[i]
+		port := firstTCPPort(service)
+		if port == 0 {
+			continue
+		}
+		target := fmt.Sprintf("%s/%s/%d", service.Namespace, service.Name, port)
+		backendAddr, err := s.resolveBackendAddr(r.Context(), service, int64(port))
+		if err != nil {
+			mu.Lock()
+			results[target] = errorResult(err)
+			mu.Unlock()
+			continue
+		}
+		backendURL := s.backendScheme(service, int64(port)) + "://" + backendAddr + "/"
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			result := checkReachable(r.Context(), client, backendURL)
+			mu.Lock()
+			results[target] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		s.logger.warning("failed writing reachability response", logFields{"error": err.Error()})
+	}
+}
+
+// Returns the first TCP port of service, or 0 if it has none.
+func firstTCPPort(service *corev1.Service) int32 {
+	for _, p := range service.Spec.Ports {
+		if p.Protocol == corev1.ProtocolTCP {
+			return p.Port
+		}
+	}
+	return 0
+}
+
+func checkReachable(ctx context.Context, client *http.Client, backendURL string) reachabilityResult {
+	ctx, cancel := context.WithTimeout(ctx, reachabilityTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, backendURL, nil)
+	if err != nil {
+		return errorResult(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errorResult(err)
+	}
+	resp.Body.Close()
+	return reachabilityResult{Status: resp.StatusCode}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReachability(t *testing.T) {
+	upServer := httptest.NewServer(&staticServer{})
+	defer upServer.Close()
+	upPort := upServer.Listener.Addr().(*net.TCPAddr).Port
+
+	// get a port with nothing listening on it
+	downServer := httptest.NewServer(&staticServer{})
+	downPort := downServer.Listener.Addr().(*net.TCPAddr).Port
+	downServer.Close()
+
+	fakeAPI := &fakeKubernetesAPIClient{}
+	for _, service := range []struct {
+		name string
+		port int
+	}{{"up", upPort}, {"down", downPort}} {
+		fakeAPI.services.Items = append(fakeAPI.services.Items, corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: service.name},
+			Spec: corev1.ServiceSpec{
+				ClusterIP: "localhost",
+				Ports: []corev1.ServicePort{{
+					Protocol: corev1.ProtocolTCP,
+					Port:     int32(service.port),
+				}},
+			},
+		})
+	}
+	kwp := newServer(fakeAPI)
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/reachability", nil)
+	recorder := httptest.NewRecorder()
+	kwp.reachabilityHandler(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Fatal("expected status OK", recorder.Code, recorder.Body.String())
+	}
+	results := map[string]reachabilityResult{}
+	err := json.Unmarshal(recorder.Body.Bytes(), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected 2 results: %#v", results)
+	}
+	for target, result := range results {
+		if target == "namespace/up/"+strconv.Itoa(upPort) {
+			if result.Status != http.StatusResetContent || result.Error != "" {
+				t.Errorf("%s: expected status 205: %#v", target, result)
+			}
+		} else if target == "namespace/down/"+strconv.Itoa(downPort) {
+			if result.Status != 0 || result.Error == "" || result.Category != errorCategoryConnectionRefused {
+				t.Errorf("%s: expected connection refused error: %#v", target, result)
+			}
+		} else {
+			t.Errorf("unexpected target %s", target)
+		}
+	}
+}
+
+func TestReachabilityAccessRules(t *testing.T) {
+	backend := httptest.NewServer(&staticServer{})
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	fakeAPI := &fakeKubernetesAPIClient{}
+	for _, service := range []struct {
+		namespace string
+		name      string
+	}{{"namespace", "allowed"}, {"namespace", "denied"}, {"hidden", "service"}} {
+		fakeAPI.services.Items = append(fakeAPI.services.Items, corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: service.namespace, Name: service.name},
+			Spec: corev1.ServiceSpec{
+				ClusterIP: "localhost",
+				Ports:     []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: int32(port)}},
+			},
+		})
+	}
+	kwp := newServer(fakeAPI)
+	var err error
+	kwp.denyServices, err = parseServiceSet("namespace/denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kwp.hiddenNamespaces = map[string]bool{"hidden": true}
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/reachability", nil)
+	recorder := httptest.NewRecorder()
+	kwp.reachabilityHandler(recorder, r)
+	results := map[string]reachabilityResult{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "namespace/allowed/" + strconv.Itoa(port)
+	if _, ok := results[expected]; !ok || len(results) != 1 {
+		t.Errorf("results=%#v; expected only %s", results, expected)
+	}
+}
+
+func TestReachabilityHTTPS(t *testing.T) {
+	backend := httptest.NewTLSServer(&staticServer{})
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	fakeAPI := &fakeKubernetesAPIClient{}
+	fakeAPI.services.Items = append(fakeAPI.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service", Annotations: map[string]string{
+			schemeAnnotationPrefix + strconv.Itoa(port): "https",
+		}},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "localhost",
+			Ports:     []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: int32(port)}},
+		},
+	})
+	kwp := newServer(fakeAPI)
+	kwp.reverseProxy.Transport = newBackendTransport(0, true, 0)
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/reachability", nil)
+	recorder := httptest.NewRecorder()
+	kwp.reachabilityHandler(recorder, r)
+	results := map[string]reachabilityResult{}
+	err := json.Unmarshal(recorder.Body.Bytes(), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := results["namespace/service/"+strconv.Itoa(port)]
+	if result.Status != http.StatusResetContent {
+		t.Errorf("result=%#v; expected status 205 over https", result)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const refreshHeader = "Refresh"
+
+// Returns the start and end of the URL in a Refresh header or meta refresh content value, e.g.
+// `0; url="/next"`, or -1, -1 if it has no URL. Follows the HTML spec's parsing loosely.
+func findRefreshURL(value string) (int, int) {
+	separator := strings.IndexAny(value, ";,")
+	if separator < 0 {
+		return -1, -1
+	}
+	start := separator + 1
+	skipSpaces := func() {
+		for start < len(value) && (value[start] == ' ' || value[start] == '\t') {
+			start++
+		}
+	}
+	skipSpaces()
+	// "url=" is optional
+	if len(value)-start >= 3 && strings.EqualFold(value[start:start+3], "url") {
+		afterURL := start + 3
+		for afterURL < len(value) && (value[afterURL] == ' ' || value[afterURL] == '\t') {
+			afterURL++
+		}
+		if afterURL < len(value) && value[afterURL] == '=' {
+			start = afterURL + 1
+			skipSpaces()
+		}
+	}
+
+	end := len(value)
+	if start < len(value) && (value[start] == '"' || value[start] == '\'') {
+		quote := value[start]
+		start++
+		if quoteEnd := strings.IndexByte(value[start:], quote); quoteEnd >= 0 {
+			end = start + quoteEnd
+		}
+	} else {
+		end = start + len(strings.TrimRight(value[start:], " \t"))
+	}
+	if start >= end {
+		return -1, -1
+	}
+	return start, end
+}
+
+// Rewrites the URL in a Refresh header or meta refresh content value like a Location header.
+func rewriteRefresh(value string, rootPath string, destPath string, proxyHosts map[string]bool) string {
+	start, end := findRefreshURL(value)
+	if start < 0 {
+		return value
+	}
+	refreshURL := stripProxyHost(value[start:end], proxyHosts)
+	return value[:start] + rewriteURLFrom(refreshURL, rootPath, destPath) + value[end:]
+}
+
+// Returns true if t is <meta http-equiv="refresh">.
+func isMetaRefresh(t *html.Token) bool {
+	if t.DataAtom != atom.Meta {
+		return false
+	}
+	for _, attr := range t.Attr {
+		if attr.Key == "http-equiv" && strings.EqualFold(strings.TrimSpace(attr.Val), "refresh") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRefresh(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"0;url=/next", "0;url=/root/next"},
+		{"5; URL = /next?a=b", "5; URL = /root/next?a=b"},
+		{`0; url="/next"`, `0; url="/root/next"`},
+		{`0; url='/next' `, `0; url='/root/next' `},
+		{"3, /next", "3, /root/next"},
+		{"0; url=http://proxy.example/next", "0; url=/root/next"},
+		// relative and external URLs are not changed
+		{"0; url=next", "0; url=next"},
+		{"0; url=https://other.example/", "0; url=https://other.example/"},
+		// no URL: refreshes the same page
+		{"30", "30"},
+		{"30;", "30;"},
+		{"", ""},
+	}
+	proxyHosts := map[string]bool{"proxy.example": true}
+	for _, test := range tests {
+		output := rewriteRefresh(test.input, "/root", "/", proxyHosts)
+		if output != test.expected {
+			t.Errorf("rewriteRefresh(%#v)=%#v; expected %#v", test.input, output, test.expected)
+		}
+	}
+}
+
+func TestRewriteMetaRefresh(t *testing.T) {
+	input := `<head><meta http-equiv="Refresh" content="0; url=/next"><meta name="description" content="0; url=/x"></head>`
+	expected := `<head><meta http-equiv="Refresh" content="0; url=/root/next"><meta name="description" content="0; url=/x"></head>`
+	out := &strings.Builder{}
+	err := rewriteAbsolutePathLinks(out, strings.NewReader(input), "/root", rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("output=%#v; expected %#v", out.String(), expected)
+	}
+}
+
+func TestProxyRefreshHeader(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Refresh", "2; url=/done")
+	}))
+	kwp := newServer(fakeAPI)
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/wait", port), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	expected := fmt.Sprintf("2; url=/namespace/service/%d/done", port)
+	if recorder.Header().Get("Refresh") != expected {
+		t.Errorf("Refresh=%#v; expected %#v", recorder.Header().Get("Refresh"), expected)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Prefix of service annotations that set the scheme used to connect to a port, e.g.
+// kubewebproxy.evanj/scheme-8443: https. Without the annotation, ports named https, ports with
+// appProtocol https, and port 443 use HTTPS; all others use HTTP.
+const schemeAnnotationPrefix = "kubewebproxy.evanj/scheme-"
+
+// Returns the scheme (http or https) used to connect to port of service.
+func (s *server) backendScheme(service *corev1.Service, port int64) string {
+	annotation := schemeAnnotationPrefix + strconv.FormatInt(port, 10)
+	if scheme, ok := service.Annotations[annotation]; ok {
+		if scheme == "http" || scheme == "https" {
+			return scheme
+		}
+		s.logger.warning("ignoring invalid annotation", logFields{"namespace": service.Namespace,
+			"service": service.Name, "annotation": annotation, "value": scheme})
+	}
+
+	if port == 443 {
+		return "https"
+	}
+	for _, p := range service.Spec.Ports {
+		if int64(p.Port) != port {
+			continue
+		}
+		if p.Name == "https" || (p.AppProtocol != nil && *p.AppProtocol == "https") {
+			return "https"
+		}
+	}
+	return "http"
+}
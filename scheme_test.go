@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBackendScheme(t *testing.T) {
+	https := "https"
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			schemeAnnotationPrefix + "8443": "https",
+			schemeAnnotationPrefix + "443":  "http",
+			schemeAnnotationPrefix + "81":   "ftp",
+		}},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+			{Name: "https", Port: 9443},
+			{Name: "web", Port: 9000, AppProtocol: &https},
+			{Name: "http", Port: 80},
+		}},
+	}
+	expected := map[int64]string{
+		8443: "https",
+		443:  "http",
+		81:   "http",
+		9443: "https",
+		9000: "https",
+		80:   "http",
+	}
+	kwp := newServer(&fakeKubernetesAPIClient{})
+	for port, scheme := range expected {
+		if output := kwp.backendScheme(service, port); output != scheme {
+			t.Errorf("backendScheme(%d)=%#v; expected %#v", port, output, scheme)
+		}
+	}
+	if output := kwp.backendScheme(&corev1.Service{}, 443); output != "https" {
+		t.Errorf("backendScheme(443)=%#v; expected https", output)
+	}
+}
+
+func TestProxyHTTPSBackend(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-TLS", fmt.Sprint(r.TLS != nil))
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	fakeAPI := &fakeKubernetesAPIClient{}
+	fakeAPI.services.Items = append(fakeAPI.services.Items, corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "service"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "127.0.0.1",
+			Ports: []corev1.ServicePort{{
+				Name:     "https",
+				Protocol: corev1.ProtocolTCP,
+				Port:     int32(port),
+			}},
+		},
+	})
+	path := fmt.Sprintf("/namespace/service/%d/", port)
+
+	// the test certificate is self-signed, so it fails verification by default
+	kwp := newServer(fakeAPI)
+	kwp.reverseProxy.Transport = newBackendTransport(0, false, 0)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("verified self-signed backend: status=%d; expected %d", recorder.Code, http.StatusBadGateway)
+	}
+
+	kwp.reverseProxy.Transport = newBackendTransport(0, true, 0)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("X-TLS") != "true" {
+		t.Errorf("status=%d X-TLS=%#v; expected 200 over TLS", recorder.Code, recorder.Header().Get("X-TLS"))
+	}
+}
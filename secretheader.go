@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Service annotation that sets a request header to the value of a key in a Secret in the
+// service's namespace: (secretName)/(key):(HeaderName), e.g. api-key/token:Authorization.
+// Requires -injectHeaderSecrets.
+const injectHeaderSecretAnnotation = "kubewebproxy.evanj/injectHeaderSecret"
+
+// default for -secretCacheTTL
+const defaultSecretCacheTTL = time.Minute
+
+type secretInfo interface {
+	getSecret(ctx context.Context, namespace string, name string) (*corev1.Secret, error)
+}
+
+func (k *kubernetesAPIClient) getSecret(ctx context.Context, namespace string, name string) (*corev1.Secret, error) {
+	return k.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// Wraps a secretInfo to reuse secrets for ttl, so proxied requests do not each read the Secret.
+// Changed secrets are used after up to ttl.
+type cachingSecretInfo struct {
+	secretInfo
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[[2]string]cachedSecret
+}
+
+type cachedSecret struct {
+	secret  *corev1.Secret
+	expires time.Time
+}
+
+func newCachingSecretInfo(secrets secretInfo, ttl time.Duration) *cachingSecretInfo {
+	return &cachingSecretInfo{
+		secretInfo: secrets,
+		ttl:        ttl,
+		now:        time.Now,
+		entries:    map[[2]string]cachedSecret{},
+	}
+}
+
+func (c *cachingSecretInfo) getSecret(ctx context.Context, namespace string, name string) (*corev1.Secret, error) {
+	key := [2]string{namespace, name}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.secret, nil
+	}
+
+	secret, err := c.secretInfo.getSecret(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for otherKey, other := range c.entries {
+		if !now.Before(other.expires) {
+			delete(c.entries, otherKey)
+		}
+	}
+	c.entries[key] = cachedSecret{secret, now.Add(c.ttl)}
+	return secret, nil
+}
+
+// A parsed injectHeaderSecretAnnotation.
+type secretHeaderRef struct {
+	secret string
+	key    string
+	header string
+}
+
+func parseSecretHeaderRef(value string) (secretHeaderRef, error) {
+	secretKey, header, ok := strings.Cut(value, ":")
+	secret, key, ok2 := strings.Cut(secretKey, "/")
+	ref := secretHeaderRef{strings.TrimSpace(secret), strings.TrimSpace(key), strings.TrimSpace(header)}
+	if !ok || !ok2 || ref.secret == "" || ref.key == "" || !httpguts.ValidHeaderFieldName(ref.header) {
+		return secretHeaderRef{}, fmt.Errorf("%#v must be (secretName)/(key):(HeaderName)", value)
+	}
+	return ref, nil
+}
+
+// Sets the request header named by service's injectHeaderSecretAnnotation, replacing any value
+// sent by the client. The value is never logged or included in errors.
+func (s *server) injectSecretHeader(ctx context.Context, header http.Header, service *corev1.Service) error {
+	annotation, ok := service.Annotations[injectHeaderSecretAnnotation]
+	if !ok {
+		return nil
+	}
+	if s.secrets == nil {
+		return fmt.Errorf("service %s/%s has annotation %s but -injectHeaderSecrets is not enabled",
+			service.Namespace, service.Name, injectHeaderSecretAnnotation)
+	}
+	ref, err := parseSecretHeaderRef(annotation)
+	if err != nil {
+		return fmt.Errorf("service %s/%s: invalid annotation %s: %s",
+			service.Namespace, service.Name, injectHeaderSecretAnnotation, err.Error())
+	}
+
+	secret, err := s.secrets.getSecret(ctx, service.Namespace, ref.secret)
+	if err != nil {
+		// not %w: a missing secret is a proxy configuration error, not a missing page
+		return fmt.Errorf("service %s/%s: could not read secret %s: %s",
+			service.Namespace, service.Name, ref.secret, err.Error())
+	}
+	value, ok := secret.Data[ref.key]
+	if !ok {
+		return fmt.Errorf("service %s/%s: secret %s has no key %s",
+			service.Namespace, service.Name, ref.secret, ref.key)
+	}
+	// secrets created from files often end with a newline, which is not valid in a header
+	headerValue := strings.TrimRight(string(value), "\r\n")
+	if !httpguts.ValidHeaderFieldValue(headerValue) {
+		return fmt.Errorf("service %s/%s: secret %s key %s is not a valid header value",
+			service.Namespace, service.Name, ref.secret, ref.key)
+	}
+	s.logger.info("injecting header from secret", logFields{"namespace": service.Namespace,
+		"service": service.Name, "secret": ref.secret, "key": ref.key, "header": ref.header})
+	header.Set(ref.header, headerValue)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type fakeSecretClient struct {
+	secrets  []corev1.Secret
+	getCalls int
+}
+
+func (f *fakeSecretClient) getSecret(ctx context.Context, namespace string, name string) (*corev1.Secret, error) {
+	f.getCalls++
+	for i := range f.secrets {
+		if f.secrets[i].Namespace == namespace && f.secrets[i].Name == name {
+			return &f.secrets[i], nil
+		}
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+}
+
+func TestParseSecretHeaderRef(t *testing.T) {
+	ref, err := parseSecretHeaderRef("api-key/token:Authorization")
+	if err != nil || ref != (secretHeaderRef{"api-key", "token", "Authorization"}) {
+		t.Errorf("ref=%#v err=%v", ref, err)
+	}
+	for _, invalid := range []string{"", "api-key", "api-key/token", "api-key:Authorization",
+		"/token:Authorization", "api-key/:Authorization", "api-key/token:", "api-key/token:Bad Header"} {
+		_, err := parseSecretHeaderRef(invalid)
+		if err == nil {
+			t.Errorf("parseSecretHeaderRef(%#v) should fail", invalid)
+		}
+	}
+}
+
+func TestInjectSecretHeader(t *testing.T) {
+	const secretValue = "Bearer s3cret"
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "authorization=%s", r.Header.Get("Authorization"))
+	}))
+	fakeAPI.services.Items[0].Annotations = map[string]string{
+		injectHeaderSecretAnnotation: "api-key/token:Authorization"}
+	secrets := &fakeSecretClient{secrets: []corev1.Secret{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "api-key"},
+		Data:       map[string][]byte{"token": []byte(secretValue + "\n")},
+	}}}
+	kwp := newServer(fakeAPI)
+
+	// the annotation without -injectHeaderSecrets is an error: do not send unauthenticated requests
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("secrets disabled: status=%d; expected 500", recorder.Code)
+	}
+
+	logOutput := &bytes.Buffer{}
+	log.SetOutput(logOutput)
+	defer log.SetOutput(os.Stderr)
+	kwp.secrets = newCachingSecretInfo(secrets, time.Minute)
+	for i := 0; i < 2; i++ {
+		r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+		// the client's value is replaced
+		r.Header.Set("Authorization", "Bearer client")
+		recorder = httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Code != http.StatusOK || recorder.Body.String() != "authorization="+secretValue {
+			t.Errorf("status=%d body=%#v; expected the secret's value", recorder.Code, recorder.Body.String())
+		}
+	}
+	if secrets.getCalls != 1 {
+		t.Errorf("getCalls=%d; expected the secret to be cached", secrets.getCalls)
+	}
+	if strings.Contains(logOutput.String(), "s3cret") {
+		t.Errorf("the secret value must not be logged:\n%s", logOutput.String())
+	}
+
+	// missing secrets and keys are errors, not 404s
+	for _, annotation := range []string{"missing/token:Authorization", "api-key/missing:Authorization"} {
+		fakeAPI.services.Items[0].Annotations[injectHeaderSecretAnnotation] = annotation
+		r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+		recorder = httptest.NewRecorder()
+		kwp.proxyErrWrapper(recorder, r)
+		if recorder.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status=%d; expected 500", annotation, recorder.Code)
+		}
+	}
+}
+
+func TestInjectSecretHeaderPodAnnotation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "leak=%s", r.Header.Get("X-Leak"))
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	s := newServer(&fakeKubernetesAPIClient{})
+	secrets := &fakeSecretClient{secrets: []corev1.Secret{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "api-key"},
+		Data:       map[string][]byte{"token": []byte("s3cret")},
+	}}}
+	s.secrets = newCachingSecretInfo(secrets, time.Minute)
+	pod := newTestPod("127.0.0.1", port)
+	pod.Annotations = map[string]string{injectHeaderSecretAnnotation: "api-key/token:X-Leak"}
+	s.pods = &fakePodClient{[]corev1.Pod{pod}}
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/_pods/namespace/pod/%d/", port), nil)
+	recorder := httptest.NewRecorder()
+	s.rootHandler(recorder, r)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "leak=" {
+		t.Errorf("status=%d body=%#v; expected the pod annotation to be ignored",
+			recorder.Code, recorder.Body.String())
+	}
+	if secrets.getCalls != 0 {
+		t.Errorf("getCalls=%d; pod annotations must not read secrets", secrets.getCalls)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How often shutdown checks if hijacked connections have closed.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Tracks connections hijacked by protocol upgrades (e.g. websockets). http.Server.Shutdown does
+// not wait for or close these, so they could keep running until the process is killed.
+type hijackedConns struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+func newHijackedConns() *hijackedConns {
+	return &hijackedConns{conns: map[*trackedConn]struct{}{}}
+}
+
+// Returns a ResponseWriter that tracks the connection if it is hijacked.
+func (h *hijackedConns) track(w http.ResponseWriter) http.ResponseWriter {
+	return &hijackTrackingWriter{w, h}
+}
+
+func (h *hijackedConns) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.conns)
+}
+
+// Closes all tracked connections and returns the number closed.
+func (h *hijackedConns) closeAll() int {
+	h.mu.Lock()
+	conns := h.conns
+	h.conns = map[*trackedConn]struct{}{}
+	h.mu.Unlock()
+
+	for conn := range conns {
+		conn.Conn.Close()
+	}
+	return len(conns)
+}
+
+type hijackTrackingWriter struct {
+	http.ResponseWriter
+	conns *hijackedConns
+}
+
+func (w *hijackTrackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	tracked := &trackedConn{Conn: conn, conns: w.conns}
+	w.conns.mu.Lock()
+	w.conns.conns[tracked] = struct{}{}
+	w.conns.mu.Unlock()
+	return tracked, rw, nil
+}
+
+// Unwrap allows http.ResponseController to flush the underlying ResponseWriter.
+func (w *hijackTrackingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// A hijacked connection that stops being tracked when it is closed.
+type trackedConn struct {
+	net.Conn
+	conns *hijackedConns
+}
+
+func (c *trackedConn) Close() error {
+	c.conns.mu.Lock()
+	delete(c.conns.conns, c)
+	c.conns.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// Stops httpServer from accepting connections, then waits up to gracePeriod for requests and
+// hijacked connections to finish. Hijacked connections still open after that are closed.
+func (s *server) shutdown(httpServer *http.Server, gracePeriod time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	err := httpServer.Shutdown(ctx)
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.hijacked.count() > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+	if closed := s.hijacked.closeAll(); closed > 0 {
+		s.logger.warning("shutdown: closed hijacked connections after the grace period", logFields{
+			"closed": closed, "grace_period": gracePeriod.String()})
+		if err == nil {
+			err = fmt.Errorf("closed %d hijacked connections: %w", closed, ctx.Err())
+		}
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Accepts a protocol upgrade, then echoes everything received.
+func echoUpgradeHandler(w http.ResponseWriter, r *http.Request) {
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	rw.Flush()
+	io.Copy(conn, rw)
+}
+
+func TestShutdownClosesWebsockets(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(echoUpgradeHandler))
+	kwp := newServer(fakeAPI)
+	proxyServer := httptest.NewServer(http.HandlerFunc(kwp.rootHandler))
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /namespace/service/%d/ws HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n", port)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status=%d; expected 101", resp.StatusCode)
+	}
+	conn.Write([]byte("ping\n"))
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("echo=%#v, %v", line, err)
+	}
+	if kwp.hijacked.count() != 1 {
+		t.Errorf("hijacked connections=%d; expected 1", kwp.hijacked.count())
+	}
+
+	// with an expired grace period, shutdown closes the websocket
+	err = kwp.shutdown(proxyServer.Config, 0)
+	if err == nil {
+		t.Error("shutdown should report that it closed connections")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = reader.ReadString('\n')
+	if err != io.EOF {
+		t.Errorf("read after shutdown returned %v; expected EOF", err)
+	}
+	if kwp.hijacked.count() != 0 {
+		t.Errorf("hijacked connections=%d after shutdown; expected 0", kwp.hijacked.count())
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Service annotation marking the service's proxy access as deprecated, with the date it will be
+// removed, as YYYY-MM-DD or RFC 3339. Responses get Deprecation and Sunset headers (RFC 8594).
+const sunsetAnnotation = "kubewebproxy.evanj/sunset"
+
+// Returns the sunset time from annotations, or false if it is not set or invalid.
+func (s *server) serviceSunset(namespace string, name string, annotations map[string]string) (time.Time, bool) {
+	value, ok := annotations[sunsetAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		sunset, err := time.Parse(layout, value)
+		if err == nil {
+			return sunset, true
+		}
+	}
+	s.logger.warning("ignoring invalid annotation", logFields{"namespace": namespace,
+		"service": name, "annotation": sunsetAnnotation, "value": value})
+	return time.Time{}, false
+}
+
+// Adds the Deprecation and Sunset headers to header if the service has a sunset.
+func (s *server) addSunsetHeaders(header http.Header, origData origRequestData) {
+	sunset, ok := s.serviceSunset(origData.namespace, origData.service, origData.annotations)
+	if !ok {
+		return
+	}
+	header.Set("Deprecation", "true")
+	header.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+}
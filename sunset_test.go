@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSunset(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	kwp := newServer(fakeAPI)
+
+	// not annotated: no headers or badge
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Header().Get("Sunset") != "" || recorder.Header().Get("Deprecation") != "" {
+		t.Errorf("unexpected headers for a service without sunset: %v", recorder.Header())
+	}
+
+	fakeAPI.services.Items[0].Annotations = map[string]string{sunsetAnnotation: "2030-06-01"}
+	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Header().Get("Sunset") != "Sat, 01 Jun 2030 00:00:00 GMT" {
+		t.Errorf("Sunset=%#v", recorder.Header().Get("Sunset"))
+	}
+	if recorder.Header().Get("Deprecation") != "true" {
+		t.Errorf("Deprecation=%#v", recorder.Header().Get("Deprecation"))
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder = httptest.NewRecorder()
+	kwp.rootHandler(recorder, r)
+	expected := "<strong>deprecated</strong> (access ends 2030-06-01)"
+	if !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("root page should contain %#v:\n%s", expected, recorder.Body.String())
+	}
+
+	// invalid dates are ignored
+	fakeAPI.services.Items[0].Annotations[sunsetAnnotation] = "next week"
+	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil)
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Header().Get("Sunset") != "" {
+		t.Errorf("Sunset=%#v for an invalid date", recorder.Header().Get("Sunset"))
+	}
+}
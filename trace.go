@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Google Cloud Trace context header: TRACE_ID/SPAN_ID;o=OPTIONS, where TRACE_ID is 32 hex
+// digits and SPAN_ID is a decimal integer. See:
+// https://cloud.google.com/trace/docs/trace-context#legacy-http-header
+const cloudTraceHeader = "X-Cloud-Trace-Context"
+
+// Returns the trace ID from an X-Cloud-Trace-Context header value.
+func parseCloudTraceContext(value string) (string, bool) {
+	traceID, _, _ := strings.Cut(value, "/")
+	traceID, _, _ = strings.Cut(traceID, ";")
+	if len(traceID) != 32 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(traceID); err != nil || strings.Trim(traceID, "0") == "" {
+		return "", false
+	}
+	return strings.ToLower(traceID), true
+}
+
+// Returns a new X-Cloud-Trace-Context header value and its trace ID.
+func newCloudTraceContext() (string, string) {
+	var random [24]byte
+	_, err := rand.Read(random[:])
+	if err != nil {
+		panic(err)
+	}
+	traceID := hex.EncodeToString(random[:16])
+	// span IDs must not be zero
+	spanID := binary.BigEndian.Uint64(random[16:]) | 1
+	return fmt.Sprintf("%s/%d", traceID, spanID), traceID
+}
+
+// Returns the trace ID of r, which is forwarded to the backend in X-Cloud-Trace-Context. If r
+// does not have a valid trace context and -generateTraceIDs is set, this adds a new one.
+// Otherwise it returns the empty string.
+func (s *server) traceRequest(r *http.Request) string {
+	if traceID, ok := parseCloudTraceContext(r.Header.Get(cloudTraceHeader)); ok {
+		return traceID
+	}
+	if !s.generateTraceIDs {
+		return ""
+	}
+	value, traceID := newCloudTraceContext()
+	r.Header.Set(cloudTraceHeader, value)
+	return traceID
+}
+
+// Adds traceID to fields as trace_id, if it is set.
+func withTraceID(fields logFields, traceID string) logFields {
+	if traceID != "" {
+		fields["trace_id"] = traceID
+	}
+	return fields
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseCloudTraceContext(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{"105445aa7843bc8bf206b12000100000/1;o=1", "105445aa7843bc8bf206b12000100000"},
+		{"105445AA7843BC8BF206B12000100000", "105445aa7843bc8bf206b12000100000"},
+		{"105445aa7843bc8bf206b12000100000;o=0", "105445aa7843bc8bf206b12000100000"},
+		{"", ""},
+		{"00000000000000000000000000000000/1", ""},
+		{"not-hex-not-hex-not-hex-not-hex-/1", ""},
+		{"105445aa/1", ""},
+	}
+	for _, test := range testCases {
+		traceID, ok := parseCloudTraceContext(test.value)
+		if traceID != test.expected || ok != (test.expected != "") {
+			t.Errorf("parseCloudTraceContext(%#v)=%#v, %t; expected %#v", test.value, traceID, ok, test.expected)
+		}
+	}
+
+	value, traceID := newCloudTraceContext()
+	parsed, ok := parseCloudTraceContext(value)
+	if !ok || parsed != traceID {
+		t.Errorf("newCloudTraceContext()=%#v, %#v; parsed %#v, %t", value, traceID, parsed, ok)
+	}
+}
+
+func TestProxyCloudTrace(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Echo-Trace", r.Header.Get(cloudTraceHeader))
+	}))
+	kwp := newServer(fakeAPI)
+	logOutput := &bytes.Buffer{}
+	kwp.logger = newJSONLogger(logOutput)
+	// the trace context is forwarded even if it is not allowed explicitly
+	kwp.forwardHeaders = map[string]bool{}
+	path := fmt.Sprintf("/namespace/service/%d/", port)
+
+	const traceContext = "105445aa7843bc8bf206b12000100000/1;o=1"
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set(cloudTraceHeader, traceContext)
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, r)
+	if recorder.Header().Get("Echo-Trace") != traceContext {
+		t.Errorf("backend received %s=%#v; expected %#v",
+			cloudTraceHeader, recorder.Header().Get("Echo-Trace"), traceContext)
+	}
+	if !strings.Contains(logOutput.String(), `"trace_id":"105445aa7843bc8bf206b12000100000"`) {
+		t.Errorf("logs must contain the trace ID:\n%s", logOutput.String())
+	}
+
+	// without a trace context: only added with generateTraceIDs
+	logOutput.Reset()
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if recorder.Header().Get("Echo-Trace") != "" || strings.Contains(logOutput.String(), "trace_id") {
+		t.Errorf("trace context must not be generated by default: %#v", recorder.Header().Get("Echo-Trace"))
+	}
+
+	kwp.generateTraceIDs = true
+	logOutput.Reset()
+	recorder = httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	traceID, ok := parseCloudTraceContext(recorder.Header().Get("Echo-Trace"))
+	if !ok {
+		t.Fatalf("backend must receive a generated trace context: %#v", recorder.Header().Get("Echo-Trace"))
+	}
+	if !strings.Contains(logOutput.String(), `"trace_id":"`+traceID+`"`) {
+		t.Errorf("logs must contain the generated trace ID %s:\n%s", traceID, logOutput.String())
+	}
+}
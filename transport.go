@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type dialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+
+// Limits the number of concurrent dials to each destination address, to avoid overwhelming a
+// single backend during connection storms. Dials to different destinations are independent.
+type dialLimiter struct {
+	dial  dialFunc
+	limit int
+
+	mu         sync.Mutex
+	semaphores map[string]*dialSemaphore
+}
+
+// Limits dials to one address. Removed from dialLimiter.semaphores when no dials use it, so
+// addresses of backends that are gone are not kept forever.
+type dialSemaphore struct {
+	slots chan struct{}
+	// number of dials waiting for or holding a slot; protected by dialLimiter.mu
+	users int
+}
+
+func newDialLimiter(dial dialFunc, limit int) *dialLimiter {
+	return &dialLimiter{dial: dial, limit: limit, semaphores: map[string]*dialSemaphore{}}
+}
+
+func (d *dialLimiter) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	semaphore := d.semaphores[addr]
+	if semaphore == nil {
+		semaphore = &dialSemaphore{slots: make(chan struct{}, d.limit)}
+		d.semaphores[addr] = semaphore
+	}
+	semaphore.users++
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		semaphore.users--
+		if semaphore.users == 0 {
+			delete(d.semaphores, addr)
+		}
+		d.mu.Unlock()
+	}()
+
+	select {
+	case semaphore.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-semaphore.slots }()
+	return d.dial(ctx, network, addr)
+}
+
+// Returns the transport used to connect to backends. If maxDialsPerBackend is > 0, it limits
+// the number of concurrent dials to each backend address. If insecureSkipVerify is true, HTTPS
+// backends are not verified, which permits in-cluster self-signed certificates. If
+// upstreamTimeout is > 0, it limits the time to connect, and then the time to wait for the
+// response headers.
+func newBackendTransport(maxDialsPerBackend int, insecureSkipVerify bool, upstreamTimeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if upstreamTimeout > 0 {
+		dialer := &net.Dialer{Timeout: upstreamTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.ResponseHeaderTimeout = upstreamTimeout
+	}
+	if insecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if maxDialsPerBackend > 0 {
+		transport.DialContext = newDialLimiter(transport.DialContext, maxDialsPerBackend).DialContext
+	}
+	return transport
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialLimiter(t *testing.T) {
+	const limit = 2
+	var mu sync.Mutex
+	active := map[string]int{}
+	maxActive := map[string]int{}
+	release := make(chan struct{})
+	dial := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		mu.Lock()
+		active[addr]++
+		if active[addr] > maxActive[addr] {
+			maxActive[addr] = active[addr]
+		}
+		mu.Unlock()
+
+		<-release
+		mu.Lock()
+		active[addr]--
+		mu.Unlock()
+		return nil, nil
+	}
+	limiter := newDialLimiter(dial, limit)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.DialContext(context.Background(), "tcp", "a:80")
+		}()
+	}
+	// a different destination is not blocked by the dials to a:80
+	otherDone := make(chan struct{})
+	go func() {
+		limiter.DialContext(context.Background(), "tcp", "b:80")
+		close(otherDone)
+	}()
+
+	// wait until the limited dials and the other dial are all in progress
+	for {
+		mu.Lock()
+		inProgress := active["a:80"] == limit && active["b:80"] == 1
+		mu.Unlock()
+		if inProgress {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	<-otherDone
+
+	if maxActive["a:80"] != limit {
+		t.Errorf("max concurrent dials to a:80=%d; expected %d", maxActive["a:80"], limit)
+	}
+	// semaphores are removed when their dials finish
+	if len(limiter.semaphores) != 0 {
+		t.Errorf("semaphores=%v; expected none after all dials finished", limiter.semaphores)
+	}
+
+	// a cancelled context stops waiting
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	defer close(unblock)
+	blocked := newDialLimiter(func(context.Context, string, string) (net.Conn, error) {
+		close(started)
+		<-unblock
+		return nil, nil
+	}, 1)
+	go blocked.DialContext(context.Background(), "tcp", "a:80")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := blocked.DialContext(ctx, "tcp", "a:80")
+	if err != context.DeadlineExceeded {
+		t.Error("expected DeadlineExceeded", err)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	release := make(chan struct{})
+	fakeAPI, port := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer close(release)
+	kwp := newServer(fakeAPI)
+	const upstreamTimeout = 50 * time.Millisecond
+	kwp.reverseProxy.Transport = newBackendTransport(0, false, upstreamTimeout)
+
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	kwp.proxyErrWrapper(recorder, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/namespace/service/%d/", port), nil))
+	duration := time.Since(start)
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("status=%d; expected %d", recorder.Code, http.StatusGatewayTimeout)
+	}
+	if duration < upstreamTimeout || duration > 5*time.Second {
+		t.Errorf("request took %s; expected about %s", duration, upstreamTimeout)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestProxyWebsocket(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	kwp := newServer(fakeAPI)
+	proxyServer := httptest.NewServer(http.HandlerFunc(kwp.rootHandler))
+	defer proxyServer.Close()
+
+	proxyURL := strings.Replace(proxyServer.URL, "http://", "ws://", 1)
+	conn, err := websocket.Dial(fmt.Sprintf("%s/namespace/service/%d/ws", proxyURL, port), "", proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, message := range []string{"hello", "world"} {
+		err = websocket.Message.Send(conn, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var received string
+		err = websocket.Message.Receive(conn, &received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received != message {
+			t.Errorf("received %#v; expected %#v", received, message)
+		}
+	}
+
+	// the service and port are still checked before upgrading
+	_, err = websocket.Dial(proxyURL+"/namespace/service/1/ws", "", proxyServer.URL)
+	if err == nil {
+		t.Error("websocket to a port the service does not have must fail")
+	}
+}
+
+func TestProxyMaxWebsockets(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.maxWebsockets = 2
+	proxyServer := httptest.NewServer(http.HandlerFunc(kwp.rootHandler))
+	defer proxyServer.Close()
+	wsURL := fmt.Sprintf("%s/namespace/service/%d/ws", strings.Replace(proxyServer.URL, "http://", "ws://", 1), port)
+
+	var conns []*websocket.Conn
+	for i := 0; i < kwp.maxWebsockets; i++ {
+		conn, err := websocket.Dial(wsURL, "", proxyServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	// use a plain request to check the status code
+	r, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/namespace/service/%d/ws", proxyServer.URL, port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("websocket over the limit: status=%d; expected %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	// closing a connection frees its slot
+	conns[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for kwp.activeWebsockets.Load() >= int64(kwp.maxWebsockets) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the closed websocket to be released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	conn, err := websocket.Dial(wsURL, "", proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestProxyWebsocketIdleTimeout(t *testing.T) {
+	fakeAPI, port := newTestBackend(t, websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	kwp := newServer(fakeAPI)
+	kwp.websocketIdleTimeout = 100 * time.Millisecond
+	proxyServer := httptest.NewServer(http.HandlerFunc(kwp.rootHandler))
+	defer proxyServer.Close()
+
+	proxyURL := strings.Replace(proxyServer.URL, "http://", "ws://", 1)
+	conn, err := websocket.Dial(fmt.Sprintf("%s/namespace/service/%d/ws", proxyURL, port), "", proxyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// messages more often than the timeout keep the connection open
+	for i := 0; i < 3; i++ {
+		time.Sleep(kwp.websocketIdleTimeout / 2)
+		err = websocket.Message.Send(conn, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var received string
+		err = websocket.Message.Receive(conn, &received)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an idle connection is closed by the proxy
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	var received string
+	err = websocket.Message.Receive(conn, &received)
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("err=%v after %s; expected the idle connection to be closed", err, time.Since(start))
+	}
+}